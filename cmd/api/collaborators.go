@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.temideewan.net/internal/data"
+	"greenlight.temideewan.net/internal/validator"
+)
+
+func (app *application) listMovieCollaboratorsHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.readMovieParam(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.authorizeMovieEdit(w, r, movie) {
+		return
+	}
+
+	collaborators, err := app.models.Collaborators.GetAllForMovie(movie.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"collaborators": collaborators}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) addMovieCollaboratorHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.readMovieParam(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.authorizeMovieManage(w, r, movie) {
+		return
+	}
+
+	var input struct {
+		UserID int64 `json:"user_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.UserID > 0, "user_id", "must be provided")
+	v.Check(movie.CreatedBy == nil || input.UserID != *movie.CreatedBy, "user_id", "must not be the owner of the movie")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.Get(input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("user_id", "no matching user found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Collaborators.Insert(movie.ID, input.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	collaborators, err := app.models.Collaborators.GetAllForMovie(movie.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"collaborators": collaborators}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) removeMovieCollaboratorHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.readMovieParam(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("user_id"), 10, 64)
+	if err != nil || userID < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// collaborators may take themselves off a movie, everyone else needs to be able to
+	// manage it.
+	if userID != app.contextGetUser(r).ID && !app.authorizeMovieManage(w, r, movie) {
+		return
+	}
+
+	err = app.models.Collaborators.Delete(movie.ID, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "collaborator successfully removed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -9,7 +9,12 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey        = contextKey("user")
+	tokenContextKey       = contextKey("token")
+	permissionsContextKey = contextKey("permissions")
+	apiKeyContextKey      = contextKey("apiKey")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +28,41 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// the bearer token the request was authenticated with. For signed tokens only the
+// family and expiry are known, and Plaintext is left empty.
+func (app *application) contextSetToken(r *http.Request, token *data.Token) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetToken(r *http.Request) *data.Token {
+	token, ok := r.Context().Value(tokenContextKey).(*data.Token)
+	if !ok {
+		panic("missing token value in request context")
+	}
+	return token
+}
+
+// permissions that were already resolved for the request, either the ones carried in
+// a signed token or the ones requirePermission looked up.
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
+
+// the API key the request was authenticated with, or nil if it wasn't made with one
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
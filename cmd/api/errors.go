@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -50,6 +53,17 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	message := "unable to update the record due to an edit conflict, please try again."
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
 }
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has changed since you fetched it, please fetch it again and retry"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+func (app *application) preconditionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this request must include an If-Match header with the record's ETag"
+	app.errorResponse(w, r, http.StatusPreconditionRequired, message)
+}
+func (app *application) patchTestFailedResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, http.StatusConflict, err.Error())
+}
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded."
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
@@ -71,7 +85,33 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	message := "your user account must be activated to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+func (app *application) suspendedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been suspended"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid, expired or revoked API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+func (app *application) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed using an API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+func (app *application) scopedTokenNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed using a token limited to some of your permissions"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many failed login attempts, please wait before trying again"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "this account has been temporarily locked due to too many failed login attempts"
+	app.errorResponse(w, r, http.StatusLocked, message)
+}
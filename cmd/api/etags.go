@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"greenlight.temideewan.net/internal/data"
+)
+
+// movieETag is the entity tag for a single movie. The version changes on every edit,
+// so it is all the tag needs.
+func movieETag(movie *data.Movie) string {
+	return fmt.Sprintf(`"%d"`, movie.Version)
+}
+
+// moviesETag is the entity tag for a page of movies, which changes whenever any of the
+// movies on it do or the page itself moves. facets is nil unless they were asked for.
+func moviesETag(movies []*data.Movie, metadata data.Metadata, facets *data.MovieFacets) string {
+	hash := sha256.New()
+
+	fmt.Fprintf(hash, "%d:%d:%d;", metadata.CurrentPage, metadata.PageSize, metadata.TotalRecords)
+	for _, movie := range movies {
+		fmt.Fprintf(hash, "%d:%d;", movie.ID, movie.Version)
+	}
+
+	if facets != nil {
+		for _, group := range [][]data.Facet{facets.Genres, facets.Decades, facets.Runtimes} {
+			for _, facet := range group {
+				fmt.Fprintf(hash, "%s:%d;", facet.Value, facet.Count)
+			}
+			fmt.Fprint(hash, "|")
+		}
+	}
+
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// etagListed reports whether an If-Match or If-None-Match header value lists etag, or
+// is "*". With weak set, W/ prefixes are ignored as If-None-Match requires.
+func etagListed(header, etag string, weak bool) bool {
+	for tag := range strings.SplitSeq(header, ",") {
+		tag = strings.TrimSpace(tag)
+
+		if tag == "*" {
+			return true
+		}
+
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+			etag = strings.TrimPrefix(etag, "W/")
+		}
+
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag header and, if the client's If-None-Match header shows it
+// already has this representation, sends a 304 and returns true.
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !etagListed(header, etag, true) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// checkIfMatch makes sure the client's If-Match header is for the current version of
+// the resource, sending a 412 and returning false if it isn't. Requests without the
+// header are let through, unless the server is configured to require it.
+func (app *application) checkIfMatch(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+
+	if header == "" {
+		if app.config.movies.requireIfMatch {
+			app.preconditionRequiredResponse(w, r)
+			return false
+		}
+		return true
+	}
+
+	if !etagListed(header, etag, false) {
+		app.preconditionFailedResponse(w, r)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"greenlight.temideewan.net/internal/data"
+)
+
+func newTestApplication() *application {
+	return &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+}
+
+func TestMovieETag(t *testing.T) {
+	got := movieETag(&data.Movie{ID: 1, Version: 3})
+	if got != `"3"` {
+		t.Errorf("got %s, want %q", got, `"3"`)
+	}
+}
+
+func TestMoviesETag(t *testing.T) {
+	movies := []*data.Movie{{ID: 1, Version: 1}, {ID: 2, Version: 4}}
+	metadata := data.Metadata{CurrentPage: 1, PageSize: 20, TotalRecords: 2}
+	facets := &data.MovieFacets{Genres: []data.Facet{{Value: "drama", Count: 2}}}
+
+	base := moviesETag(movies, metadata, nil)
+
+	tests := []struct {
+		name     string
+		movies   []*data.Movie
+		metadata data.Metadata
+		facets   *data.MovieFacets
+		same     bool
+	}{
+		{"unchanged", []*data.Movie{{ID: 1, Version: 1}, {ID: 2, Version: 4}}, metadata, nil, true},
+		{"movie edited", []*data.Movie{{ID: 1, Version: 2}, {ID: 2, Version: 4}}, metadata, nil, false},
+		{"movie removed", movies[:1], metadata, nil, false},
+		{"different page", movies, data.Metadata{CurrentPage: 2, PageSize: 20, TotalRecords: 2}, nil, false},
+		{"total changed", movies, data.Metadata{CurrentPage: 1, PageSize: 20, TotalRecords: 3}, nil, false},
+		{"with facets", movies, metadata, facets, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := moviesETag(tt.movies, tt.metadata, tt.facets)
+			if (got == base) != tt.same {
+				t.Errorf("got %s, base %s, want same: %t", got, base, tt.same)
+			}
+		})
+	}
+
+	otherFacets := &data.MovieFacets{Genres: []data.Facet{{Value: "drama", Count: 3}}}
+	if moviesETag(movies, metadata, facets) == moviesETag(movies, metadata, otherFacets) {
+		t.Error("ETag didn't change with the facet counts")
+	}
+}
+
+func TestETagListed(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		weak   bool
+		want   bool
+	}{
+		{"exact", `"3"`, `"3"`, false, true},
+		{"different", `"2"`, `"3"`, false, false},
+		{"one of several", `"1", "3" ,"5"`, `"3"`, false, true},
+		{"wildcard", `*`, `"3"`, false, true},
+		{"weak tag with strong comparison", `W/"3"`, `"3"`, false, false},
+		{"weak tag with weak comparison", `W/"3"`, `"3"`, true, true},
+		{"unquoted", `3`, `"3"`, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagListed(tt.header, tt.etag, tt.weak); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        bool
+	}{
+		{"no header", "", false},
+		{"current", `"3"`, true},
+		{"weak current", `W/"3"`, true},
+		{"stale", `"2"`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication()
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rr := httptest.NewRecorder()
+
+			got := app.notModified(rr, r, `"3"`)
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+			if etag := rr.Header().Get("ETag"); etag != `"3"` {
+				t.Errorf("got ETag %s, want %q", etag, `"3"`)
+			}
+			if got && rr.Code != http.StatusNotModified {
+				t.Errorf("got status %d, want %d", rr.Code, http.StatusNotModified)
+			}
+		})
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		ifMatch    string
+		require    bool
+		want       bool
+		wantStatus int
+	}{
+		{"no header", "", false, true, http.StatusOK},
+		{"no header when required", "", true, false, http.StatusPreconditionRequired},
+		{"current", `"3"`, true, true, http.StatusOK},
+		{"wildcard", `*`, false, true, http.StatusOK},
+		{"stale", `"2"`, false, false, http.StatusPreconditionFailed},
+		{"weak", `W/"3"`, false, false, http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication()
+			app.config.movies.requireIfMatch = tt.require
+
+			r := httptest.NewRequest(http.MethodPatch, "/v1/movies/1", nil)
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			rr := httptest.NewRecorder()
+
+			got := app.checkIfMatch(rr, r, `"3"`)
+			if got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rr.Code, tt.wantStatus)
+			}
+		})
+	}
+}
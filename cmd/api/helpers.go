@@ -9,8 +9,10 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.temideewan.net/internal/data"
 	"greenlight.temideewan.net/internal/validator"
 )
 
@@ -25,6 +27,64 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// readMovieParam looks up the movie named by the id parameter, sending a 404 and
+// returning false if there isn't one.
+func (app *application) readMovieParam(w http.ResponseWriter, r *http.Request) (*data.Movie, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return movie, true
+}
+
+// readUserParam looks up the user named by the id parameter, sending a 404 and
+// returning false if there isn't one.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// readVersionParam reads a movie version from the named route parameter
+func (app *application) readVersionParam(r *http.Request, name string) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	version, err := strconv.ParseInt(params.ByName(name), 10, 32)
+
+	if err != nil || version < 1 {
+		return 0, errors.New("invalid version parameter")
+	}
+	return int32(version), nil
+}
+
 type envelope map[string]any
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
@@ -147,6 +207,42 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readBool returns nil when the key is missing, so callers can tell "not given" apart
+// from false.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
+// readTime accepts either an RFC 3339 timestamp or a plain date, which is taken as
+// midnight UTC. A missing key gives the zero time.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return time.Time{}
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t
+		}
+	}
+
+	v.AddError(key, "must be a date or an RFC 3339 timestamp")
+	return time.Time{}
+}
+
 func (app *application) background(fn func()) {
 	// launch goroutine in the background
 	app.wg.Add(1)
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// startJobs launches the maintenance tasks that run for the lifetime of the server.
+func (app *application) startJobs() {
+	app.every(time.Hour, func() error {
+		deleted, err := app.models.Users.DeleteScheduled()
+		if deleted > 0 {
+			app.logger.Info("purged deleted user accounts", "count", deleted)
+		}
+		return err
+	})
+
+	if app.config.movies.trashRetention > 0 {
+		app.every(time.Hour, func() error {
+			purged, err := app.models.Movies.PurgeDeletedBefore(time.Now().Add(-app.config.movies.trashRetention))
+			if purged > 0 {
+				app.logger.Info("purged movies from the trash", "count", purged)
+			}
+			return err
+		})
+	}
+
+	if app.config.permissions.cacheTTL > 0 {
+		app.every(app.config.permissions.cacheTTL, func() error {
+			app.models.Permissions.PruneCache()
+			return nil
+		})
+	}
+}
+
+// every runs fn once per interval until the server starts shutting down. The loop runs
+// under app.background, so shutdown waits for a run which is in progress to finish.
+func (app *application) every(interval time.Duration, fn func() error) {
+	run := func() {
+		// a panic shouldn't stop later runs
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error(fmt.Sprintf("%v", err))
+			}
+		}()
+
+		err := fn()
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	}
+
+	app.background(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-app.shutdown:
+				return
+			case <-ticker.C:
+				run()
+			}
+		}
+	})
+}
@@ -3,19 +3,29 @@ package main
 import (
 	"context"
 	"database/sql"
+	"expvar"
 	"flag"
+	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
 	"greenlight.temideewan.net/internal/data"
+	"greenlight.temideewan.net/internal/jwt"
 	"greenlight.temideewan.net/internal/mailer"
 )
 
 const version = "1.0.0"
 
+const (
+	authModeDatabase  = "database"
+	authModeStateless = "stateless"
+)
+
 type config struct {
 	port int
 	env  string
@@ -30,6 +40,39 @@ type config struct {
 		burst   int
 		enabled bool
 	}
+	auth struct {
+		mode            string
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
+		jwt             struct {
+			keys      string
+			activeKID string
+		}
+	}
+	login struct {
+		maxAttempts     int
+		window          time.Duration
+		lockoutDuration time.Duration
+		backoffBase     time.Duration
+	}
+	accounts struct {
+		deletionGracePeriod time.Duration
+		defaultRole         string
+	}
+	permissions struct {
+		cacheTTL time.Duration
+	}
+	movies struct {
+		trashRetention time.Duration
+		requireIfMatch bool
+	}
+	passwords struct {
+		hasher            string
+		argon2Memory      uint
+		argon2Iterations  uint
+		argon2Parallelism uint
+		bcryptCost        int
+	}
 	smtp struct {
 		host     string
 		port     int
@@ -44,7 +87,10 @@ type application struct {
 	logger *slog.Logger
 	models data.Models
 	mailer *mailer.Mailer
+	keyset *jwt.Keyset
 	wg     sync.WaitGroup
+	// closed when the server starts shutting down, to stop the periodic jobs
+	shutdown chan struct{}
 }
 
 func main() {
@@ -66,6 +112,37 @@ func main() {
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
+	// authentication config from command line flags
+	flag.StringVar(&cfg.auth.mode, "auth-mode", authModeDatabase, "Access token mode (database|stateless)")
+	flag.DurationVar(&cfg.auth.accessTokenTTL, "auth-access-token-ttl", 15*time.Minute, "Authentication access token lifetime")
+	flag.DurationVar(&cfg.auth.refreshTokenTTL, "auth-refresh-token-ttl", 30*24*time.Hour, "Authentication refresh token lifetime")
+	flag.StringVar(&cfg.auth.jwt.keys, "jwt-keys", os.Getenv("GREENLIGHT_JWT_KEYS"), "Signing keys for stateless access tokens (kid:secret,...)")
+	flag.StringVar(&cfg.auth.jwt.activeKID, "jwt-active-kid", "", "ID of the key used to sign new stateless access tokens")
+
+	// login brute-force protection from command line flags
+	flag.IntVar(&cfg.login.maxAttempts, "login-max-attempts", 10, "Failed logins for an account before it is locked")
+	flag.DurationVar(&cfg.login.window, "login-attempt-window", 15*time.Minute, "How long a failed login counts towards backoff and lockout")
+	flag.DurationVar(&cfg.login.lockoutDuration, "login-lockout-duration", 30*time.Minute, "How long an account stays locked")
+	flag.DurationVar(&cfg.login.backoffBase, "login-backoff-base", time.Second, "Delay after the first failed login, doubling with each further failure")
+
+	// account deletion from command line flags
+	flag.DurationVar(&cfg.accounts.deletionGracePeriod, "account-deletion-grace-period", 30*24*time.Hour, "How long a deleted account can be restored before it is purged")
+	flag.StringVar(&cfg.accounts.defaultRole, "default-role", "user", "Role assigned to newly registered users (empty for none)")
+
+	// permission cache from command line flags
+	flag.DurationVar(&cfg.permissions.cacheTTL, "permissions-cache-ttl", time.Minute, "How long a user's permissions are cached (0 to disable)")
+
+	// movie trash from command line flags
+	flag.DurationVar(&cfg.movies.trashRetention, "movies-trash-retention", 30*24*time.Hour, "How long deleted movies stay in the trash before they are purged (0 to keep them)")
+	flag.BoolVar(&cfg.movies.requireIfMatch, "movies-require-if-match", false, "Reject movie updates and deletes that don't send an If-Match header")
+
+	// password hashing from command line flags
+	flag.StringVar(&cfg.passwords.hasher, "password-hasher", "argon2id", "Password hashing algorithm (argon2id|bcrypt)")
+	flag.UintVar(&cfg.passwords.argon2Memory, "argon2-memory", 64*1024, "Argon2id memory cost in KiB")
+	flag.UintVar(&cfg.passwords.argon2Iterations, "argon2-iterations", 3, "Argon2id number of iterations")
+	flag.UintVar(&cfg.passwords.argon2Parallelism, "argon2-parallelism", 2, "Argon2id degree of parallelism")
+	flag.IntVar(&cfg.passwords.bcryptCost, "bcrypt-cost", bcrypt.DefaultCost, "Bcrypt cost")
+
 	// smtp config from command line flags
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 2525, "SMTP port")
@@ -76,6 +153,62 @@ func main() {
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
+	if cfg.auth.mode != authModeDatabase && cfg.auth.mode != authModeStateless {
+		logger.Error("auth-mode must be either database or stateless")
+		os.Exit(1)
+	}
+
+	switch cfg.passwords.hasher {
+	case "argon2id":
+		// argon2 needs at least one lane, and at least 8 KiB of memory for each of them
+		if cfg.passwords.argon2Parallelism < 1 || cfg.passwords.argon2Parallelism > math.MaxUint8 {
+			logger.Error("argon2-parallelism must be between 1 and 255")
+			os.Exit(1)
+		}
+		if cfg.passwords.argon2Iterations < 1 || cfg.passwords.argon2Iterations > math.MaxUint32 {
+			logger.Error("argon2-iterations must be between 1 and 4294967295")
+			os.Exit(1)
+		}
+		if cfg.passwords.argon2Memory < 8*cfg.passwords.argon2Parallelism || cfg.passwords.argon2Memory > math.MaxUint32 {
+			logger.Error("argon2-memory must be at least 8 KiB for each degree of parallelism, and fit in 32 bits")
+			os.Exit(1)
+		}
+
+		data.SetPasswordHasher(data.Argon2idHasher{
+			Memory:      uint32(cfg.passwords.argon2Memory),
+			Iterations:  uint32(cfg.passwords.argon2Iterations),
+			Parallelism: uint8(cfg.passwords.argon2Parallelism),
+			SaltLength:  16,
+			KeyLength:   32,
+		})
+	case "bcrypt":
+		if cfg.passwords.bcryptCost < bcrypt.MinCost || cfg.passwords.bcryptCost > bcrypt.MaxCost {
+			logger.Error(fmt.Sprintf("bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+			os.Exit(1)
+		}
+
+		data.SetPasswordHasher(data.BcryptHasher{Cost: cfg.passwords.bcryptCost})
+	default:
+		logger.Error("password-hasher must be either argon2id or bcrypt")
+		os.Exit(1)
+	}
+
+	// Load the keyset whenever keys are configured, so that signed tokens which are
+	// still valid keep working after switching back to database mode.
+	var keyset *jwt.Keyset
+
+	if cfg.auth.jwt.keys != "" {
+		ks, err := jwt.NewKeyset(cfg.auth.jwt.keys, cfg.auth.jwt.activeKID)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		keyset = ks
+	} else if cfg.auth.mode == authModeStateless {
+		logger.Error("jwt-keys must be provided in stateless auth mode")
+		os.Exit(1)
+	}
+
 	db, err := openDB(cfg)
 
 	if err != nil {
@@ -95,12 +228,35 @@ func main() {
 	}
 
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer,
+		config:   cfg,
+		logger:   logger,
+		models:   data.NewModels(db),
+		mailer:   mailer,
+		keyset:   keyset,
+		shutdown: make(chan struct{}),
+	}
+
+	// check the default role now, rather than failing every signup
+	if cfg.accounts.defaultRole != "" {
+		exists, err := app.models.Roles.Exists(cfg.accounts.defaultRole)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		if !exists {
+			logger.Error("default-role must be the name of an existing role", "role", cfg.accounts.defaultRole)
+			os.Exit(1)
+		}
 	}
 
+	app.models.Permissions.SetCacheTTL(cfg.permissions.cacheTTL)
+
+	expvar.Publish("permission_cache", expvar.Func(func() any {
+		return app.models.Permissions.CacheStats()
+	}))
+
+	app.startJobs()
+
 	err = app.serve()
 	if err != nil {
 		logger.Error(err.Error())
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 	"greenlight.temideewan.net/internal/data"
+	"greenlight.temideewan.net/internal/jwt"
 	"greenlight.temideewan.net/internal/validator"
 )
 
@@ -91,6 +93,12 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// so we need to include that in the Vary header
 		// this prevents caching issues with shared caches
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			app.authenticateAPIKey(w, r, next, apiKey)
+			return
+		}
 
 		authorizationHeader := r.Header.Get("Authorization")
 
@@ -106,13 +114,54 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 		token := headerParts[1]
 
+		if strings.HasPrefix(token, data.APIKeyPrefix) {
+			app.authenticateAPIKey(w, r, next, token)
+			return
+		}
+
+		// signed tokens carry the user's ID, activation state and permissions, so we
+		// can trust them without a trip to the database once the signature checks out.
+		if app.keyset != nil && jwt.IsJWT(token) {
+			claims, err := app.keyset.Verify(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			token := &data.Token{
+				UserID: userID,
+				Expiry: time.Unix(claims.Expiry, 0),
+				Scope:  data.ScopeAuthentication,
+				Family: claims.SessionID,
+			}
+
+			// the claims only carry the permissions the token ended up with, which for
+			// a scoped token is all we need to know that it was scoped
+			if claims.Scoped {
+				token.Permissions = append(data.Permissions{}, claims.Permissions...)
+			}
+
+			r = app.contextSetUser(r, &data.User{ID: userID, Activated: claims.Activated})
+			r = app.contextSetToken(r, token)
+			r = app.contextSetPermissions(r, data.Permissions(claims.Permissions))
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		v := validator.New()
 
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, authToken, err := app.models.Users.GetForAuthenticationToken(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -123,12 +172,54 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		app.background(func() {
+			err := app.models.Token.UpdateLastUsed(token)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, authToken)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateAPIKey authenticates the request as the owner of an API key. The
+// requirePermission middleware then limits it to the permissions granted to the key.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	key, user, err := app.models.APIKeys.GetForPlaintext(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.background(func() {
+		err := app.models.APIKeys.UpdateLastUsed(key.ID)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -144,6 +235,11 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
+		if user.Suspended {
+			app.suspendedAccountResponse(w, r)
+			return
+		}
+
 		if !user.Activated {
 			app.inactiveAccountResponse(w, r)
 			return
@@ -154,14 +250,44 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
-func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		// retrieve user from the request context
+// requireUserCredentials is for endpoints that manage a user's own sessions and
+// credentials, which shouldn't be reachable with an API key or a token limited to
+// some of the user's permissions.
+func (app *application) requireUserCredentials(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
 
-		user := app.contextGetUser(r)
+		if app.contextGetToken(r).Permissions != nil {
+			app.scopedTokenNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+	return app.requireAuthenticatedUser(fn)
+}
+
+// requireUserToken is for endpoints that act on the token the request was made with,
+// like logging out. Any authentication token can use them, scoped or not, but an API
+// key can't.
+func (app *application) requireUserToken(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
 
-		// get the slice of permissions for the user
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		next.ServeHTTP(w, r)
+	})
+	return app.requireAuthenticatedUser(fn)
+}
+
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		permissions, r, err := app.requestPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -177,3 +303,35 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	}
 	return app.requireActivatedUser(fn)
 }
+
+// requestPermissions returns the permissions the request may use, along with a
+// request that remembers them so later checks in the same request don't look them up
+// again.
+func (app *application) requestPermissions(r *http.Request) (data.Permissions, *http.Request, error) {
+	// get the slice of permissions for the user, unless they came with the token or
+	// were already looked up
+	permissions, ok := app.contextGetPermissions(r)
+	if !ok {
+		var err error
+
+		permissions, err = app.models.Permissions.GetAllForUser(app.contextGetUser(r).ID)
+		if err != nil {
+			return nil, r, err
+		}
+
+		r = app.contextSetPermissions(r, permissions)
+	}
+
+	// requests made with an API key only get the permissions granted to the key
+	if key := app.contextGetAPIKey(r); key != nil {
+		permissions = permissions.Intersect(key.Permissions)
+	}
+
+	// and tokens issued for some of the user's permissions only get those. Signed
+	// tokens are already limited when they are issued.
+	if token, ok := r.Context().Value(tokenContextKey).(*data.Token); ok && token.Permissions != nil {
+		permissions = permissions.Intersect(token.Permissions)
+	}
+
+	return permissions, r, nil
+}
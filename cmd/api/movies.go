@@ -3,9 +3,12 @@ package main
 import (
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"strings"
 
 	"greenlight.temideewan.net/internal/data"
+	"greenlight.temideewan.net/internal/jsonpatch"
 	"greenlight.temideewan.net/internal/validator"
 )
 
@@ -23,17 +26,21 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	user := app.contextGetUser(r)
+
 	// after json is read successfully
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		Runtime:   input.Runtime,
+		Genres:    input.Genres,
+		CreatedBy: &user.ID,
 	}
 	v := validator.New()
 
 	if data.ValidateMovie(v, movie); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
 	err = app.models.Movies.Insert(movie)
 	if err != nil {
@@ -43,6 +50,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("ETag", movieETag(movie))
 
 	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
 
@@ -71,6 +79,11 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+
+	if app.notModified(w, r, movieETag(movie)) {
+		return
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -94,31 +107,101 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
+	if !app.authorizeMovieEdit(w, r, movie) {
+		return
 	}
 
-	err = app.readJSON(w, r, &input)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
+	if !app.checkIfMatch(w, r, movieETag(movie)) {
 		return
 	}
-	if input.Title != nil {
-		movie.Title = *input.Title
+
+	// the patch format is picked by the Content-Type header, and anything that isn't
+	// one of the standard patch types is treated as the fields to change.
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case mediaTypeMergePatch, mediaTypeJSONPatch:
+		err = app.patchMovie(w, r, movie, mediaType)
+		if err != nil {
+			switch {
+			case errors.Is(err, jsonpatch.ErrTestFailed):
+				app.patchTestFailedResponse(w, r, err)
+			default:
+				app.badRequestResponse(w, r, err)
+			}
+			return
+		}
+
+	default:
+		var input struct {
+			Title   *string       `json:"title"`
+			Year    *int32        `json:"year"`
+			Runtime *data.Runtime `json:"runtime"`
+			Genres  []string      `json:"genres"`
+		}
+
+		err = app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		if input.Title != nil {
+			movie.Title = *input.Title
+		}
+		if input.Year != nil {
+			movie.Year = *input.Year
+		}
+		if input.Runtime != nil {
+			movie.Runtime = *input.Runtime
+		}
+		if input.Genres != nil {
+			movie.Genres = input.Genres
+		}
 	}
-	if input.Year != nil {
-		movie.Year = *input.Year
+
+	app.saveMovie(w, r, movie)
+}
+
+// replaceMovieHandler replaces every field of a movie, so unlike updateMovieHandler
+// all of them have to be sent.
+func (app *application) replaceMovieHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.readMovieParam(w, r)
+	if !ok {
+		return
 	}
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
+
+	if !app.authorizeMovieEdit(w, r, movie) {
+		return
 	}
-	if input.Genres != nil {
-		movie.Genres = input.Genres
+
+	if !app.checkIfMatch(w, r, movieETag(movie)) {
+		return
 	}
 
+	var input struct {
+		Title   string       `json:"title"`
+		Year    int32        `json:"year"`
+		Runtime data.Runtime `json:"runtime"`
+		Genres  []string     `json:"genres"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	movie.Title = input.Title
+	movie.Year = input.Year
+	movie.Runtime = input.Runtime
+	movie.Genres = input.Genres
+
+	app.saveMovie(w, r, movie)
+}
+
+// saveMovie validates a movie which has been changed by the request and saves it as a
+// new version, sending the updated movie back.
+func (app *application) saveMovie(w http.ResponseWriter, r *http.Request, movie *data.Movie) {
 	v := validator.New()
 
 	if data.ValidateMovie(v, movie); !v.Valid() {
@@ -126,7 +209,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Update(movie)
+	err := app.models.Movies.Update(movie, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -137,7 +220,10 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -150,7 +236,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Delete(id)
+	movie, err := app.models.Movies.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -160,7 +246,26 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		}
 		return
 	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
+
+	if !app.authorizeMovieEdit(w, r, movie) {
+		return
+	}
+
+	if !app.checkIfMatch(w, r, movieETag(movie)) {
+		return
+	}
+
+	err = app.models.Movies.Delete(movie, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully moved to the trash"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -168,8 +273,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		data.MovieFilters
 		data.Filters
 	}
 
@@ -177,11 +281,140 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 	qs := r.URL.Query()
 
-	input.Title = app.readStrings(qs, "title", "")
+	input.Title = strings.TrimSpace(app.readStrings(qs, "title", ""))
+	input.Language = app.readStrings(qs, "language", "")
+	if fuzzy := app.readBool(qs, "fuzzy", v); fuzzy != nil {
+		input.Fuzzy = *fuzzy
+	}
 	input.Genres = app.readCSV(qs, "genres", []string{})
-	input.Filters.Sort = app.readStrings(qs, "sort", "id")
+	input.AnyGenres = app.readCSV(qs, "genres_any", []string{})
+	input.ExcludeGenres = app.readCSV(qs, "genres_exclude", []string{})
+	input.YearMin = int32(app.readInt(qs, "year_min", 0, v))
+	input.YearMax = int32(app.readInt(qs, "year_max", 0, v))
+	input.RuntimeMin = data.Runtime(app.readInt(qs, "runtime_min", 0, v))
+	input.RuntimeMax = data.Runtime(app.readInt(qs, "runtime_max", 0, v))
+	input.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.CreatedBefore = app.readTime(qs, "created_before", v)
+
+	includeFacets := app.readBool(qs, "facets", v)
+
+	if cursor := qs.Get("cursor"); cursor != "" {
+		var err error
+
+		input.Filters.Cursor, err = data.DecodeCursor(cursor)
+		if err != nil {
+			v.AddError("cursor", "must be a cursor from a previous page")
+		}
+	}
+
+	// a cursor only makes sense for the sort it was made for, so that is the default
+	// when one is given
+	defaultSort := "id"
+	if input.Filters.Cursor != nil {
+		defaultSort = input.Filters.Cursor.Sort
+	}
+
+	input.Filters.Sort = app.readStrings(qs, "sort", defaultSort)
+
+	input.Filters.SortSafeList = []string{"id", "title", "year", "runtime", "relevance", "-id", "-title", "-year", "-runtime"}
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// totals are counted by default when paging by number, as they always have been,
+	// but have to be asked for when paging with cursors.
+	includeTotal := app.readBool(qs, "include_total", v)
+	input.Filters.IncludeTotal = input.Filters.Cursor == nil
+	if includeTotal != nil {
+		input.Filters.IncludeTotal = *includeTotal
+	}
+
+	data.ValidateMovieFilters(v, input.MovieFilters)
+	v.Check(input.Filters.Sort != "relevance" || input.Title != "", "sort", "relevance can only be used with a title search")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, metaData, err := app.models.Movies.GetAll(input.MovieFilters, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"movies": movies, "metadata": metaData}
+
+	// facets count every movie matching the filters, not just the ones on this page
+	var facets *data.MovieFacets
+
+	if includeFacets != nil && *includeFacets {
+		facets, err = app.models.Movies.GetFacets(input.MovieFilters)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env["facets"] = facets
+	}
+
+	if app.notModified(w, r, moviesETag(movies, metaData, facets)) {
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// autocompleteMoviesHandler suggests titles for what the user has typed so far. The
+// suggestions only change when movies do, so browsers may reuse them for a minute.
+func (app *application) autocompleteMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	search := strings.TrimSpace(qs.Get("q"))
+	limit := app.readInt(qs, "limit", 10, v)
+
+	v.Check(search != "", "q", "must be provided")
+	v.Check(len(search) <= 100, "q", "must not be more than 100 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than 0")
+	v.Check(limit <= 20, "limit", "must be a maximum of 20")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, err := app.models.Movies.Autocomplete(search, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "private, max-age=60")
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestions": suggestions}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listDeletedMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
 
-	input.Filters.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	qs := r.URL.Query()
+
+	input.Filters.Sort = app.readStrings(qs, "sort", "-deleted_at")
+
+	input.Filters.SortSafeList = []string{"id", "title", "deleted_at", "-id", "-title", "-deleted_at"}
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
@@ -191,7 +424,16 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	movies, metaData, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	permissions, r, err := app.requestPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// everyone sees the movies they could restore, which for admins is all of them
+	user := app.contextGetUser(r)
+
+	movies, metaData, err := app.models.Movies.GetAllDeleted(user.ID, permissions.Include("movies:admin"), input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -202,3 +444,150 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.models.Movies.GetDeleted(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.authorizeMovieEdit(w, r, movie) {
+		return
+	}
+
+	if !app.checkIfMatch(w, r, movieETag(movie)) {
+		return
+	}
+
+	err = app.models.Movies.Restore(movie, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeMovieHandler permanently deletes a movie which is already in the trash. Only
+// the owner or an admin can do this, as it can't be undone.
+func (app *application) purgeMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.models.Movies.GetDeleted(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.authorizeMovieManage(w, r, movie) {
+		return
+	}
+
+	err = app.models.Movies.Purge(movie.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie permanently deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// canEditMovie reports whether the request's user may change a movie: its owner, the
+// users it has been shared with, and anyone with the movies:admin permission.
+func (app *application) canEditMovie(r *http.Request, movie *data.Movie) (bool, error) {
+	if ok, err := app.canManageMovie(r, movie); ok || err != nil {
+		return ok, err
+	}
+
+	return app.models.Collaborators.Exists(movie.ID, app.contextGetUser(r).ID)
+}
+
+// canManageMovie reports whether the request's user may decide who else can edit a
+// movie, which is left to its owner and anyone with the movies:admin permission.
+func (app *application) canManageMovie(r *http.Request, movie *data.Movie) (bool, error) {
+	user := app.contextGetUser(r)
+
+	if movie.CreatedBy != nil && *movie.CreatedBy == user.ID {
+		return true, nil
+	}
+
+	permissions, _, err := app.requestPermissions(r)
+	if err != nil {
+		return false, err
+	}
+
+	return permissions.Include("movies:admin"), nil
+}
+
+// authorizeMovieEdit sends a 403 and returns false if the user can't edit the movie.
+func (app *application) authorizeMovieEdit(w http.ResponseWriter, r *http.Request, movie *data.Movie) bool {
+	ok, err := app.canEditMovie(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// authorizeMovieManage sends a 403 and returns false if the user can't manage who
+// else may edit the movie.
+func (app *application) authorizeMovieManage(w http.ResponseWriter, r *http.Request, movie *data.Movie) bool {
+	ok, err := app.canManageMovie(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"greenlight.temideewan.net/internal/data"
+	"greenlight.temideewan.net/internal/jsonpatch"
+)
+
+const (
+	mediaTypeMergePatch = "application/merge-patch+json"
+	mediaTypeJSONPatch  = "application/json-patch+json"
+)
+
+// movieDocument is the part of a movie that patches can change, in the same shape
+// the API sends it to clients.
+type movieDocument struct {
+	Title   string       `json:"title"`
+	Year    int32        `json:"year"`
+	Runtime data.Runtime `json:"runtime"`
+	Genres  []string     `json:"genres"`
+}
+
+// patchMovie applies the merge patch or JSON patch in the request body to movie. The
+// result still has to be validated before it is saved.
+func (app *application) patchMovie(w http.ResponseWriter, r *http.Request, movie *data.Movie, mediaType string) error {
+	var patch json.RawMessage
+
+	err := app.readJSON(w, r, &patch)
+	if err != nil {
+		return err
+	}
+
+	doc, err := json.Marshal(movieDocument{
+		Title:   movie.Title,
+		Year:    movie.Year,
+		Runtime: movie.Runtime,
+		Genres:  movie.Genres,
+	})
+	if err != nil {
+		return err
+	}
+
+	switch mediaType {
+	case mediaTypeMergePatch:
+		doc, err = jsonpatch.Merge(doc, patch)
+	default:
+		doc, err = jsonpatch.Apply(doc, patch)
+	}
+	if err != nil {
+		return err
+	}
+
+	// decode strictly, so patches can't add fields a movie doesn't have
+	var patched movieDocument
+
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.DisallowUnknownFields()
+
+	err = dec.Decode(&patched)
+	if err != nil {
+		return fmt.Errorf("patched movie is invalid: %w", err)
+	}
+
+	movie.Title = patched.Title
+	movie.Year = patched.Year
+	movie.Runtime = patched.Runtime
+	movie.Genres = patched.Genres
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"greenlight.temideewan.net/internal/data"
+	"greenlight.temideewan.net/internal/validator"
+)
+
+func (app *application) listMovieRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.readMovieParam(w, r)
+	if !ok {
+		return
+	}
+
+	revisions, err := app.models.Revisions.GetAllForMovie(movie.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"revisions": revisions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showMovieRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.readMovieParam(w, r)
+	if !ok {
+		return
+	}
+
+	version, err := app.readVersionParam(r, "version")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	revision, ok := app.readRevision(w, r, movie.ID, version)
+	if !ok {
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"revision": revision}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// diffMovieRevisionsHandler lists the fields that changed between two versions of a
+// movie. By default it compares the current version with the one before it, or with
+// itself for a movie that has only one version.
+func (app *application) diffMovieRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.readMovieParam(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	to := app.readInt(qs, "to", int(movie.Version), v)
+	from := app.readInt(qs, "from", max(to-1, 1), v)
+
+	v.Check(from >= 1, "from", "must be greater than zero")
+	v.Check(to >= 1, "to", "must be greater than zero")
+	v.Check(to <= int(movie.Version), "to", "must not be more than the current version")
+	v.Check(from <= int(movie.Version), "from", "must not be more than the current version")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	fromRevision, ok := app.readRevision(w, r, movie.ID, int32(from))
+	if !ok {
+		return
+	}
+
+	toRevision, ok := app.readRevision(w, r, movie.ID, int32(to))
+	if !ok {
+		return
+	}
+
+	env := envelope{
+		"from":    from,
+		"to":      to,
+		"changes": fromRevision.Diff(toRevision),
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revertMovieHandler saves an earlier version of a movie as its newest version. Like
+// any other update it fails with an edit conflict if the movie changes in the
+// meantime.
+func (app *application) revertMovieHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.readMovieParam(w, r)
+	if !ok {
+		return
+	}
+
+	if !app.authorizeMovieEdit(w, r, movie) {
+		return
+	}
+
+	if !app.checkIfMatch(w, r, movieETag(movie)) {
+		return
+	}
+
+	version, err := app.readVersionParam(r, "version")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	revision, ok := app.readRevision(w, r, movie.ID, version)
+	if !ok {
+		return
+	}
+
+	movie.Title = revision.Title
+	movie.Year = revision.Year
+	movie.Runtime = revision.Runtime
+	movie.Genres = revision.Genres
+
+	app.saveMovie(w, r, movie)
+}
+
+// readRevision looks up a version of a movie, sending a 404 and returning false if
+// there isn't one.
+func (app *application) readRevision(w http.ResponseWriter, r *http.Request, movieID int64, version int32) (*data.MovieRevision, bool) {
+	revision, err := app.models.Revisions.Get(movieID, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return revision, true
+}
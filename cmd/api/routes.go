@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -21,18 +22,90 @@ func (app *application) routes() http.Handler {
 	// health check
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
+	// application metrics
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission("users:admin", expvar.Handler().ServeHTTP))
+
 	// movies
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.dispatchByParam("id", map[string]http.HandlerFunc{
+		"trash":        app.requirePermission("movies:write", app.listDeletedMoviesHandler),
+		"autocomplete": app.requirePermission("movies:read", app.autocompleteMoviesHandler),
+	}, app.requirePermission("movies:read", app.showMovieHandler)))
 	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id", app.requirePermission("movies:write", app.replaceMovieHandler))
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/restore", app.requirePermission("movies:write", app.restoreMovieHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/purge", app.requirePermission("movies:write", app.purgeMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/revisions", app.requirePermission("movies:read", app.listMovieRevisionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/revisions/:version", app.requirePermission("movies:read", app.showMovieRevisionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/diff", app.requirePermission("movies:read", app.diffMovieRevisionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/revert/:version", app.requirePermission("movies:write", app.revertMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/collaborators", app.requirePermission("movies:write", app.listMovieCollaboratorsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/collaborators", app.requirePermission("movies:write", app.addMovieCollaboratorHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/collaborators/:user_id", app.requirePermission("movies:write", app.removeMovieCollaboratorHandler))
 
 	// users
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireUserCredentials(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireUserCredentials(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireUserCredentials(app.exportCurrentUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireUserCredentials(app.listUserSessionsHandler))
+
+	// two-factor authentication
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireUserCredentials(app.createTOTPHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/totp", app.requireUserCredentials(app.confirmTOTPHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireUserCredentials(app.deleteTOTPHandler))
+
+	// api keys
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireUserCredentials(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireUserCredentials(app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys/:id", app.requireUserCredentials(app.showAPIKeyHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/api-keys/:id", app.requireUserCredentials(app.updateAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireUserCredentials(app.deleteAPIKeyHandler))
+
+	// user administration
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/activated", app.requirePermission("users:admin", app.updateUserActivatedHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/sessions", app.requirePermission("users:admin", app.deleteUserSessionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission("users:admin", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:admin", app.revokeUserPermissionHandler))
+
+	// roles
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("roles:admin", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/roles", app.requirePermission("roles:admin", app.createRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/roles", app.requirePermission("roles:admin", app.listUserRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("roles:admin", app.assignUserRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePermission("roles:admin", app.removeUserRoleHandler))
 
 	// tokens
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/2fa", app.createTwoFactorAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireUserToken(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireUserCredentials(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 	return app.recoverPanic(app.rateLimit(app.authenticate(router)))
 }
+
+// dispatchByParam lets static paths share a position with a wildcard, which httprouter
+// doesn't allow, by sending requests where the named parameter matches one of the
+// routes to that handler and everything else to next.
+func (app *application) dispatchByParam(param string, routes map[string]http.HandlerFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := httprouter.ParamsFromContext(r.Context()).ByName(param)
+
+		if handler, ok := routes[value]; ok {
+			handler(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
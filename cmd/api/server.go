@@ -60,6 +60,9 @@ func (app *application) serve() error {
 
 		app.logger.Info("completing background tasks", "addr", srv.Addr)
 
+		// stop the periodic jobs, so that they don't start any more background tasks
+		close(app.shutdown)
+
 		// wait for any background tasks using a wait group
 		app.wg.Wait()
 		shutdownError <- nil
@@ -2,17 +2,52 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/tomasen/realip"
 	"greenlight.temideewan.net/internal/data"
+	"greenlight.temideewan.net/internal/jwt"
 	"greenlight.temideewan.net/internal/validator"
 )
 
+// tokenScope is the optional part of a login request that restricts the tokens it
+// issues, for handing to scripts and other less trusted clients.
+type tokenScope struct {
+	Permissions []string `json:"permissions"`
+	TTL         *string  `json:"ttl"`
+}
+
+// validateTokenScope checks a requested token scope, returning the requested lifetime
+// or zero if none was asked for.
+func (app *application) validateTokenScope(v *validator.Validator, scope tokenScope) time.Duration {
+	if scope.Permissions != nil {
+		v.Check(validator.Unique(scope.Permissions), "permissions", "must not contain duplicate values")
+	}
+
+	if scope.TTL == nil {
+		return 0
+	}
+
+	ttl, err := time.ParseDuration(*scope.TTL)
+	if err != nil {
+		v.AddError("ttl", "must be a duration such as 30m or 12h")
+		return 0
+	}
+
+	v.Check(ttl >= time.Minute, "ttl", "must be at least 1 minute")
+	v.Check(ttl <= app.config.auth.refreshTokenTTL, "ttl", fmt.Sprintf("must not be more than %s", app.config.auth.refreshTokenTTL))
+
+	return ttl
+}
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		tokenScope
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -25,17 +60,25 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	data.ValidateEmail(v, input.Email)
 	data.ValidatePassword(v, input.Password)
+	ttl := app.validateTokenScope(v, input.tokenScope)
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	ip := realip.FromRequest(r)
+
+	status, ok := app.checkLoginAttempts(w, r, input.Email, ip)
+	if !ok {
+		return
+	}
+
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
+			app.failedLoginResponse(w, r, input.Email, ip, status, nil)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -48,18 +91,593 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	if !match {
+		app.failedLoginResponse(w, r, input.Email, ip, status, user)
+		return
+	}
+
+	err = app.models.Logins.Clear(input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// now that we have the plaintext password, take the chance to upgrade hashes made
+	// with an older algorithm or weaker parameters.
+	if user.Password.NeedsRehash() {
+		err = app.models.Users.Rehash(user, input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// users with two-factor authentication enabled get a short-lived token instead,
+	// which has to be exchanged along with a code for their authentication tokens.
+	credential, err := app.models.TOTP.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if credential != nil && credential.Confirmed {
+		token, err := app.models.Token.New(user.ID, 5*time.Minute, data.ScopeTwoFactor)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env := envelope{
+			"two_factor_token": token,
+			"message":          "send this token, a code from your authenticator app and any permissions or ttl to POST /v1/tokens/2fa",
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.issueAuthenticationTokens(w, r, user, input.Permissions, ttl)
+}
+
+// checkLoginAttempts looks up the recent failed attempts to log in to the account with
+// the given email address, or from the given IP address. If the account is locked or
+// the client has to back off for a while it sends the error response and returns
+// false.
+func (app *application) checkLoginAttempts(w http.ResponseWriter, r *http.Request, email, ip string) (*data.LoginStatus, bool) {
+	status, err := app.models.Logins.Status(email, ip, time.Now().Add(-app.config.login.window))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if time.Now().Before(status.LockedUntil) {
+		app.accountLockedResponse(w, r, time.Until(status.LockedUntil))
+		return nil, false
+	}
+
+	// make the client wait longer after each failed attempt, whether they have been
+	// guessing at one account or trying lots of accounts from the same address.
+	wait := max(
+		app.loginBackoff(status.EmailFailures, status.LastEmailFailure),
+		app.loginBackoff(status.IPFailures, status.LastIPFailure),
+	)
+	if wait > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, wait)
+		return nil, false
+	}
+
+	return status, true
+}
+
+// loginBackoff returns how much longer a client has to wait before trying to log in
+// again, given the number of recent failures and when the last one happened.
+func (app *application) loginBackoff(failures int, lastFailure time.Time) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+
+	delay := min(app.config.login.backoffBase<<min(failures-1, 16), app.config.login.lockoutDuration)
+	return time.Until(lastFailure.Add(delay))
+}
+
+// failedLoginResponse records a failed login attempt and sends the invalid credentials
+// response, or the account locked response if it was one failure too many.
+func (app *application) failedLoginResponse(w http.ResponseWriter, r *http.Request, email, ip string, status *data.LoginStatus, user *data.User) {
+	locked, err := app.recordFailedLogin(email, ip, status, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if locked {
+		app.accountLockedResponse(w, r, app.config.login.lockoutDuration)
+		return
+	}
+
+	app.invalidCredentialsResponse(w, r)
+}
+
+// recordFailedLogin records a failed attempt to log in, or to prove who the user is
+// some other way. Once an email address has had too many failures the account is
+// locked, the owner (if there is one) is told about it and it returns true.
+func (app *application) recordFailedLogin(email, ip string, status *data.LoginStatus, user *data.User) (bool, error) {
+	err := app.models.Logins.RecordFailure(email, ip)
+	if err != nil {
+		return false, err
+	}
+
+	app.background(func() {
+		err := app.models.Logins.DeleteExpired(time.Now().Add(-app.config.login.window))
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	if status.EmailFailures+1 < app.config.login.maxAttempts {
+		return false, nil
+	}
+
+	lockedUntil := time.Now().Add(app.config.login.lockoutDuration)
+
+	err = app.models.Logins.Lock(email, lockedUntil)
+	if err != nil {
+		return false, err
+	}
+
+	// start counting afresh once the lock expires
+	err = app.models.Logins.Clear(email)
+	if err != nil {
+		return false, err
+	}
+
+	if user != nil {
+		app.background(func() {
+			data := map[string]any{
+				"ipAddress":   ip,
+				"lockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+			}
+			err := app.mailer.Send(user.Email, "account_locked.tmpl", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+
+	return true, nil
+}
+
+func (app *application) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlainText string `json:"token"`
+		Code           string `json:"code"`
+		tokenScope
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TokenPlainText)
+	data.ValidateSecondFactor(v, input.Code)
+	ttl := app.validateTokenScope(v, input.tokenScope)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeTwoFactor, input.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired two-factor token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// two-factor authentication may have been turned off since the password was checked
+	credential, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	match, err := app.models.TOTP.UseCode(credential, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		match, err = app.models.TOTP.UseRecoveryCode(user.ID, input.Code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// whether or not the code was right, the two-factor token is used up. This means
+	// codes can't be guessed without getting the password right again each time.
+	err = app.models.Token.DeleteAllForUsers(data.ScopeTwoFactor, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	if !match {
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	token, err := app.models.Token.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	app.issueAuthenticationTokens(w, r, user, input.Permissions, ttl)
+}
+
+// issueAuthenticationTokens starts a new session for a user who has successfully logged
+// in, and sends back its access and refresh tokens. If permissions isn't nil the
+// tokens are limited to them. If a ttl is given a single access token with that
+// lifetime is issued instead, which is always stored in the database so that it can
+// be revoked.
+func (app *application) issueAuthenticationTokens(w http.ResponseWriter, r *http.Request, user *data.User, permissions []string, ttl time.Duration) {
+	if permissions != nil {
+		held, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		v := validator.New()
+
+		for _, code := range permissions {
+			v.Check(held.Include(code), "permissions", fmt.Sprintf("you don't have the %q permission", code))
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	if ttl > 0 {
+		// an empty family gives the token one of its own, so it is listed with the
+		// user's sessions
+		accessToken, err := app.models.Token.NewAccess(user.ID, ttl, "", permissions, realip.FromRequest(r), r.UserAgent())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": accessToken}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	refreshToken, err := app.models.Token.NewRefresh(user.ID, app.config.auth.refreshTokenTTL, permissions, realip.FromRequest(r), r.UserAgent())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	accessToken, err := app.newAccessToken(r, user, refreshToken.Family, refreshToken.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authentication_token": accessToken, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlainText string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlainText); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	refreshToken, err := app.models.Token.Rotate(input.TokenPlainText, app.config.auth.refreshTokenTTL, realip.FromRequest(r), r.UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRefreshTokenReused):
+			app.logger.Warn("refresh token reused, token family revoked", "ip", realip.FromRequest(r))
+			v.AddError("token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the user may have been deleted after the token was rotated
+	user, err := app.models.Users.Get(refreshToken.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	accessToken, err := app.newAccessToken(r, user, refreshToken.Family, refreshToken.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authentication_token": accessToken, "refresh_token": refreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// newAccessToken issues the short-lived token clients send as their bearer token. In
+// stateless mode this is a signed token carrying everything the authenticate and
+// requirePermission middleware need, otherwise it is stored in the database. Either
+// way it is limited to scope, unless that is nil.
+func (app *application) newAccessToken(r *http.Request, user *data.User, family string, scope data.Permissions) (*data.Token, error) {
+	if app.config.auth.mode != authModeStateless {
+		return app.models.Token.NewAccess(user.ID, app.config.auth.accessTokenTTL, family, scope, realip.FromRequest(r), r.UserAgent())
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if scope != nil {
+		permissions = permissions.Intersect(scope)
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.auth.accessTokenTTL)
+
+	claims := jwt.Claims{
+		Subject:     strconv.FormatInt(user.ID, 10),
+		SessionID:   family,
+		Activated:   user.Activated,
+		Permissions: permissions,
+		Scoped:      scope != nil,
+		IssuedAt:    now.Unix(),
+		Expiry:      expiry.Unix(),
+	}
+
+	signed, err := app.keyset.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{Plaintext: signed, UserID: user.ID, Expiry: expiry, Scope: data.ScopeAuthentication, Family: family, Permissions: scope}, nil
+}
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// as with password resets, the response is the same whatever happens so that it
+	// can't be used to find out which email addresses have an account.
+	env := envelope{"message": "if an account with this email address is waiting to be activated, you will receive an email with activation instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// suspended users were deactivated by an admin and can't activate themselves again
+	if !user.Activated && !user.Suspended {
+		lastSent, err := app.models.Token.LastCreatedForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// only send one email every few minutes per address, however often this is
+		// called.
+		if time.Since(lastSent) >= 5*time.Minute {
+			err = app.models.Token.DeleteAllForUsers(data.ScopeActivation, user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			token, err := app.models.Token.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			app.background(func() {
+				data := map[string]any{
+					"activationToken": token.Plaintext,
+				}
+				err := app.mailer.Send(user.Email, "token_activation.tmpl", data)
+				if err != nil {
+					app.logger.Error(err.Error())
+				}
+			})
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// we always send back the same response so that the endpoint can't be used to
+	// find out which email addresses have an account.
+	env := envelope{"message": "if an activated account exists for this email address, you will receive password reset instructions"}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		token, err := app.models.Token.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			data := map[string]any{
+				"passwordResetToken": token.Plaintext,
+			}
+			err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token := app.contextGetToken(r)
+
+	var err error
+
+	// signed tokens can't be revoked, but ending their family stops them from being
+	// refreshed once they expire.
+	if token.Plaintext != "" {
+		err = app.models.Token.Delete(data.ScopeAuthentication, token.Plaintext)
+	} else {
+		err = app.models.Token.DeleteFamily(token.Family)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Token.DeleteAllSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out of all sessions"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Token.GetAllSessionsForUser(user.ID, app.contextGetToken(r))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
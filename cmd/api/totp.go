@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/tomasen/realip"
+	"greenlight.temideewan.net/internal/data"
+	"greenlight.temideewan.net/internal/totp"
+	"greenlight.temideewan.net/internal/validator"
+)
+
+func (app *application) createTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	credential, err := app.models.TOTP.New(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v := validator.New()
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"totp": map[string]string{
+			"secret": credential.Secret,
+			"uri":    totp.URI("Greenlight", user.Email, credential.Secret),
+		},
+		"message": "add this secret to your authenticator app, then confirm it with PUT /v1/users/me/totp",
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(validator.Matches(input.Code, data.TOTPCodeRX), "code", "must be a 6 digit code"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// a wrong code counts as a failed login, so that a stolen session can't be used to
+	// guess codes any faster than logging in could.
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ip := realip.FromRequest(r)
+
+	status, ok := app.checkLoginAttempts(w, r, user.Email, ip)
+	if !ok {
+		return
+	}
+
+	credential, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "two-factor authentication enrollment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if credential.Confirmed {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := app.models.TOTP.UseCode(credential, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.failedTOTPCodeResponse(w, r, ip, status, user)
+		return
+	}
+
+	err = app.models.TOTP.Confirm(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	codes, err := app.models.TOTP.NewRecoveryCodes(user.ID, 10)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"recovery_codes": codes,
+		"message":        "two-factor authentication is enabled, store these recovery codes somewhere safe",
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateSecondFactor(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// as when confirming, wrong codes count as failed logins
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ip := realip.FromRequest(r)
+
+	status, ok := app.checkLoginAttempts(w, r, user.Email, ip)
+	if !ok {
+		return
+	}
+
+	credential, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	match, err := app.models.TOTP.UseCode(credential, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		match, err = app.models.TOTP.UseRecoveryCode(user.ID, input.Code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !match {
+		app.failedTOTPCodeResponse(w, r, ip, status, user)
+		return
+	}
+
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication has been disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// failedTOTPCodeResponse records a wrong code as a failed login and sends a failed
+// validation response, unless that locked the account.
+func (app *application) failedTOTPCodeResponse(w http.ResponseWriter, r *http.Request, ip string, status *data.LoginStatus, user *data.User) {
+	locked, err := app.recordFailedLogin(user.Email, ip, status, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if locked {
+		app.accountLockedResponse(w, r, app.config.login.lockoutDuration)
+		return
+	}
+
+	v := validator.New()
+	v.AddError("code", "invalid or expired code")
+	app.failedValidationResponse(w, r, v.Errors)
+}
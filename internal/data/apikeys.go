@@ -0,0 +1,281 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.temideewan.net/internal/validator"
+)
+
+// APIKeyPrefix starts every API key, which lets the authenticate middleware tell them
+// apart from authentication tokens when they are sent as a bearer token.
+const APIKeyPrefix = "glk_"
+
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Plaintext   string      `json:"key,omitzero"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	Version     int32       `json:"version"`
+}
+
+// The plaintext key is made up of APIKeyPrefix, a short visible prefix that identifies
+// the key in listings, and a random secret. Only a hash of the full key is stored.
+func generateAPIKey(key *APIKey) {
+	key.Prefix = strings.ToLower(rand.Text()[:8])
+	key.Plaintext = APIKeyPrefix + key.Prefix + "_" + rand.Text()
+	key.Hash = hashToken(key.Plaintext)
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(strings.HasPrefix(plaintext, APIKeyPrefix), "key", "must be a valid API key")
+	v.Check(len(plaintext) == len(APIKeyPrefix)+8+1+26, "key", "must be a valid API key")
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// generate a new key for the user and store it, leaving the plaintext set on the key so
+// that it can be shown to the user this one time.
+func (m APIKeyModel) Insert(key *APIKey) error {
+	generateAPIKey(key)
+
+	query := `
+	INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at, version
+	`
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt, &key.Version)
+}
+
+func (m APIKeyModel) Get(id, userID int64) (*APIKey, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, user_id, name, prefix, permissions, expiry, created_at, last_used_at, version
+	FROM api_keys
+	WHERE id = $1 AND user_id = $2
+	`
+
+	var key APIKey
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+		&key.CreatedAt,
+		&key.LastUsedAt,
+		&key.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+	SELECT id, user_id, name, prefix, permissions, expiry, created_at, last_used_at, version
+	FROM api_keys
+	WHERE user_id = $1
+	ORDER BY id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.Expiry,
+			&key.CreatedAt,
+			&key.LastUsedAt,
+			&key.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (m APIKeyModel) Update(key *APIKey) error {
+	query := `
+	UPDATE api_keys
+	SET name = $1, permissions = $2, expiry = $3, version = version + 1
+	WHERE id = $4 AND user_id = $5 AND version = $6
+	RETURNING version
+	`
+
+	args := []any{key.Name, pq.Array(key.Permissions), key.Expiry, key.ID, key.UserID, key.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&key.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m APIKeyModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+	DELETE FROM api_keys
+	WHERE id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetForPlaintext looks up an unexpired API key along with the user who owns it.
+func (m APIKeyModel) GetForPlaintext(plaintext string) (*APIKey, *User, error) {
+	query := `
+	SELECT k.id, k.name, k.prefix, k.permissions, k.expiry,
+		u.id, u.name, u.email, u.created_at, u.activated, u.suspended, u.version, u.password_hash
+	FROM api_keys k
+	INNER JOIN users u ON u.id = k.user_id
+	WHERE k.hash = $1 AND (k.expiry IS NULL OR k.expiry > $2)
+	`
+
+	var (
+		key  APIKey
+		user User
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hashToken(plaintext), time.Now()).Scan(
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+		&user.ID,
+		&user.Name,
+		&user.Email,
+		&user.CreatedAt,
+		&user.Activated,
+		&user.Suspended,
+		&user.Version,
+		&user.Password.hash,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.UserID = user.ID
+	return &key, &user, nil
+}
+
+// record that a key has just been used, at most once a minute
+func (m APIKeyModel) UpdateLastUsed(id int64) error {
+	query := `
+	UPDATE api_keys
+	SET last_used_at = NOW()
+	WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
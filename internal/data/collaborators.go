@@ -0,0 +1,157 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// a user the owner of a movie has shared it with, who may edit it
+type Collaborator struct {
+	UserID  int64     `json:"user_id"`
+	Name    string    `json:"name"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// a movie someone else owns that the user has been made a collaborator on
+type Collaboration struct {
+	MovieID int64     `json:"movie_id"`
+	Title   string    `json:"title"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+type CollaboratorModel struct {
+	DB *sql.DB
+}
+
+func (m CollaboratorModel) GetAllForMovie(movieID int64) ([]*Collaborator, error) {
+	query := `
+	SELECT u.id, u.name, mc.created_at
+	FROM movie_collaborators mc
+	INNER JOIN users u ON u.id = mc.user_id
+	WHERE mc.movie_id = $1
+	ORDER BY mc.created_at, u.id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collaborators := []*Collaborator{}
+
+	for rows.Next() {
+		var collaborator Collaborator
+
+		err := rows.Scan(&collaborator.UserID, &collaborator.Name, &collaborator.AddedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		collaborators = append(collaborators, &collaborator)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return collaborators, nil
+}
+
+// list the movies the user has been made a collaborator on
+func (m CollaboratorModel) GetAllForUser(userID int64) ([]*Collaboration, error) {
+	query := `
+	SELECT m.id, m.title, mc.created_at
+	FROM movie_collaborators mc
+	INNER JOIN movies m ON m.id = mc.movie_id
+	WHERE mc.user_id = $1
+	ORDER BY mc.created_at, m.id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collaborations := []*Collaboration{}
+
+	for rows.Next() {
+		var collaboration Collaboration
+
+		err := rows.Scan(&collaboration.MovieID, &collaboration.Title, &collaboration.AddedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		collaborations = append(collaborations, &collaboration)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return collaborations, nil
+}
+
+func (m CollaboratorModel) Exists(movieID, userID int64) (bool, error) {
+	query := `
+	SELECT EXISTS (SELECT 1 FROM movie_collaborators WHERE movie_id = $1 AND user_id = $2)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRowContext(ctx, query, movieID, userID).Scan(&exists)
+	return exists, err
+}
+
+// share a movie with a user. Adding someone who is already a collaborator is not an
+// error.
+func (m CollaboratorModel) Insert(movieID, userID int64) error {
+	query := `
+	INSERT INTO movie_collaborators (movie_id, user_id)
+	VALUES ($1, $2)
+	ON CONFLICT DO NOTHING
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, movieID, userID)
+	return err
+}
+
+func (m CollaboratorModel) Delete(movieID, userID int64) error {
+	query := `
+	DELETE FROM movie_collaborators
+	WHERE movie_id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, movieID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Facet is the number of movies sharing a value, such as a genre.
+type Facet struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// MovieFacets breaks down the movies matching a search. Genres are ordered by count,
+// and decades and runtimes in their natural order.
+type MovieFacets struct {
+	Genres   []Facet `json:"genres"`
+	Decades  []Facet `json:"decades"`
+	Runtimes []Facet `json:"runtimes"`
+}
+
+// GetFacets counts the movies matching the filters by genre, decade and runtime, all
+// in one query. A movie counts once for each of its genres.
+func (m MovieModel) GetFacets(movieFilters MovieFilters) (*MovieFacets, error) {
+	var where Where
+
+	movieFilters.where(&where)
+
+	// position orders the decades and runtime buckets, and is 0 for the genres so that
+	// they are ordered by count instead
+	query := fmt.Sprintf(`
+		WITH matched AS (
+			SELECT genres, year, runtime
+			FROM movies
+			WHERE %s
+		)
+		SELECT 'genre', genre, 0, count(*)
+		FROM matched, unnest(genres) AS genre
+		GROUP BY genre
+		UNION ALL
+		SELECT 'decade', (year / 10 * 10)::text || 's', year / 10 * 10, count(*)
+		FROM matched
+		GROUP BY year / 10 * 10
+		UNION ALL
+		SELECT 'runtime', bucket.label, bucket.position, count(*)
+		FROM matched
+		JOIN (VALUES
+			('under 90 mins', 1, 0, 90),
+			('90-119 mins', 2, 90, 120),
+			('120-149 mins', 3, 120, 150),
+			('150+ mins', 4, 150, NULL)
+		) AS bucket (label, position, min, max)
+		ON runtime >= bucket.min AND (runtime < bucket.max OR bucket.max IS NULL)
+		GROUP BY bucket.label, bucket.position
+		ORDER BY 1, 3, 4 DESC, 2
+	`, where.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, where.Args()...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	facets := MovieFacets{
+		Genres:   []Facet{},
+		Decades:  []Facet{},
+		Runtimes: []Facet{},
+	}
+
+	for rows.Next() {
+		var (
+			kind     string
+			position int
+			facet    Facet
+		)
+
+		err := rows.Scan(&kind, &facet.Value, &position, &facet.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case "genre":
+			facets.Genres = append(facets.Genres, facet)
+		case "decade":
+			facets.Decades = append(facets.Decades, facet)
+		case "runtime":
+			facets.Runtimes = append(facets.Runtimes, facet)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &facets, nil
+}
@@ -1,16 +1,92 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"greenlight.temideewan.net/internal/validator"
 )
 
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
 type Filters struct {
 	Page         int
 	PageSize     int
 	Sort         string
 	SortSafeList []string
+	// when set, the page starts after (or before) the row the cursor points at
+	// instead of at an offset
+	Cursor *Cursor
+	// whether to count the total number of matching records, which takes an extra
+	// pass over them
+	IncludeTotal bool
+}
+
+// Cursor points at the row either side of a page, by its value in the sort column
+// and its id. Values are kept as strings whatever the column's type, and Postgres
+// casts them back when they are compared.
+type Cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int64  `json:"i"`
+	// Prev is set for cursors that fetch the page before the row
+	Prev bool `json:"p,omitzero"`
+}
+
+// Encode turns the cursor into the opaque string clients send back
+func (c Cursor) Encode() string {
+	js, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor Cursor
+
+	err = json.Unmarshal(js, &cursor)
+	if err != nil || cursor.Sort == "" || cursor.ID < 1 {
+		return nil, ErrInvalidCursor
+	}
+
+	// the value ends up compared with the sort column, so anything Postgres can't cast
+	// to the column's type has to be caught here
+	if !validCursorValue(strings.TrimPrefix(cursor.Sort, "-"), cursor.Value) {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
+
+// validCursorValue reports whether value could have come from the sort column in a
+// cursor. Columns that cursors are never made for are always invalid.
+func validCursorValue(column, value string) bool {
+	switch column {
+	case "id":
+		_, err := strconv.ParseInt(value, 10, 64)
+		return err == nil
+	case "year", "runtime":
+		_, err := strconv.ParseInt(value, 10, 32)
+		return err == nil
+	case "relevance":
+		f, err := strconv.ParseFloat(value, 32)
+		return err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+	case "title":
+		return utf8.ValidString(value) && !strings.ContainsRune(value, 0)
+	default:
+		return false
+	}
 }
 
 func (f Filters) sortColumn() string {
@@ -22,8 +98,10 @@ func (f Filters) sortColumn() string {
 	panic("unsafe sort parameter: " + f.Sort)
 }
 
+// sortDirection is DESC for sorts with a - prefix, and for relevance, which puts the
+// best matches first.
 func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
+	if strings.HasPrefix(f.Sort, "-") || f.Sort == "relevance" {
 		return "DESC"
 	}
 	return "ASC"
@@ -34,23 +112,85 @@ func (f Filters) limit() int {
 }
 
 func (f Filters) offset() int {
+	if f.Cursor != nil {
+		return 0
+	}
 	return (f.Page - 1) * f.PageSize
 }
 
+func (f Filters) backwards() bool {
+	return f.Cursor != nil && f.Cursor.Prev
+}
+
+// orderBy is the ORDER BY clause for the sort, with id as the tie-breaker. Pages
+// before a cursor are fetched in reverse and flipped back afterwards.
+func (f Filters) orderBy() string {
+	direction, idDirection := f.sortDirection(), "ASC"
+
+	if f.backwards() {
+		direction, idDirection = reverseDirection(direction), "DESC"
+	}
+
+	return fmt.Sprintf("%s %s, id %s", f.sortColumn(), direction, idDirection)
+}
+
+// keyset adds the condition which limits the results to the rows after (or before)
+// the cursor, if there is one. column is the expression for the sort column, which
+// is usually just its name.
+func (f Filters) keyset(w *Where, column string) {
+	if f.Cursor == nil {
+		return
+	}
+
+	op, idOp := ">", ">"
+	if f.sortDirection() == "DESC" {
+		op = "<"
+	}
+	if f.backwards() {
+		op, idOp = reverseOp(op), reverseOp(idOp)
+	}
+
+	value := w.Param(f.Cursor.Value)
+	id := w.Param(f.Cursor.ID)
+
+	w.Add(fmt.Sprintf("%[1]s %[2]s %[4]s OR (%[1]s = %[4]s AND id %[3]s %[5]s)", column, op, idOp, value, id))
+}
+
+func reverseDirection(direction string) string {
+	if direction == "ASC" {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func reverseOp(op string) string {
+	if op == ">" {
+		return "<"
+	}
+	return ">"
+}
+
 func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.Page > 0, "page", "must be greater than zero")
 	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
 	v.Check(f.PageSize > 0, "page_size", "must be greater than 0")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 	v.Check(validator.PermittedValue(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+
+	if f.Cursor != nil {
+		v.Check(f.Cursor.Sort == f.Sort, "cursor", "was made for a different sort")
+		v.Check(f.Page == 1, "page", "must not be used with a cursor")
+	}
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitzero"`
-	PageSize     int `json:"page_size,omitzero"`
-	FirstPage    int `json:"first_page,omitzero"`
-	LastPage     int `json:"last_page,omitzero"`
-	TotalRecords int `json:"total_records,omitzero"`
+	CurrentPage  int    `json:"current_page,omitzero"`
+	PageSize     int    `json:"page_size,omitzero"`
+	FirstPage    int    `json:"first_page,omitzero"`
+	LastPage     int    `json:"last_page,omitzero"`
+	TotalRecords int    `json:"total_records,omitzero"`
+	NextCursor   string `json:"next_cursor,omitzero"`
+	PrevCursor   string `json:"prev_cursor,omitzero"`
 }
 
 func calculateMetaData(totalRecords, page, pageSize int) Metadata {
@@ -65,3 +205,53 @@ func calculateMetaData(totalRecords, page, pageSize int) Metadata {
 		TotalRecords: totalRecords,
 	}
 }
+
+// calculateCursorMetadata builds the metadata for a page of results which was fetched
+// with one more row than the page size, to find out whether there is another page
+// beyond it. It returns the rows that belong on the page, in sorted order.
+func calculateCursorMetadata[T any](rows []T, totalRecords int, filters Filters, sortValue func(T) (string, int64)) ([]T, Metadata) {
+	more := len(rows) > filters.limit()
+	if more {
+		rows = rows[:filters.limit()]
+	}
+
+	if filters.backwards() {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	var metadata Metadata
+
+	switch {
+	case filters.Cursor != nil:
+		metadata = Metadata{PageSize: filters.PageSize, TotalRecords: totalRecords}
+	case filters.IncludeTotal:
+		metadata = calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	case len(rows) > 0:
+		metadata = Metadata{CurrentPage: filters.Page, PageSize: filters.PageSize, FirstPage: 1}
+	}
+
+	if len(rows) == 0 {
+		return rows, metadata
+	}
+
+	cursor := func(row T, prev bool) string {
+		value, id := sortValue(row)
+		return Cursor{Sort: filters.Sort, Value: value, ID: id, Prev: prev}.Encode()
+	}
+
+	// going backwards, the extra row says whether there's an earlier page. There is
+	// always a later one, since that's where the cursor came from.
+	hasNext := more || filters.backwards()
+	hasPrev := filters.offset() > 0 || (filters.Cursor != nil && (!filters.backwards() || more))
+
+	if hasNext {
+		metadata.NextCursor = cursor(rows[len(rows)-1], false)
+	}
+	if hasPrev {
+		metadata.PrevCursor = cursor(rows[0], true)
+	}
+
+	return rows, metadata
+}
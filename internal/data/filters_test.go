@@ -0,0 +1,258 @@
+package data
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+
+	"greenlight.temideewan.net/internal/validator"
+)
+
+var movieSorts = []string{"id", "title", "year", "runtime", "relevance", "-id", "-title", "-year", "-runtime"}
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursors := []Cursor{
+		{Sort: "id", Value: "5", ID: 5},
+		{Sort: "-title", Value: "Moana", ID: 3, Prev: true},
+		{Sort: "relevance", Value: "0.0607927", ID: 9},
+	}
+
+	for _, cursor := range cursors {
+		got, err := DecodeCursor(cursor.Encode())
+		if err != nil {
+			t.Fatalf("DecodeCursor(%+v): %v", cursor, err)
+		}
+		if *got != cursor {
+			t.Errorf("got %+v, want %+v", *got, cursor)
+		}
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	raw := func(js string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(js))
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"not json", raw(`nope`)},
+		{"missing sort", raw(`{"v":"1","i":1}`)},
+		{"missing id", raw(`{"s":"id","v":"1"}`)},
+		{"unknown sort", raw(`{"s":"version","v":"1","i":1}`)},
+		{"non-integer year", raw(`{"s":"year","v":"abc","i":1}`)},
+		{"year out of range", raw(`{"s":"-year","v":"99999999999","i":1}`)},
+		{"non-integer id", raw(`{"s":"id","v":"1.5","i":1}`)},
+		{"NaN relevance", raw(`{"s":"relevance","v":"NaN","i":1}`)},
+		{"title with a NUL", raw(`{"s":"title","v":"a\u0000b","i":1}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeCursor(tt.cursor)
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("got error %v, want %v", err, ErrInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	tests := []struct {
+		sort   string
+		cursor *Cursor
+		want   string
+	}{
+		{"id", nil, "id ASC, id ASC"},
+		{"-year", nil, "year DESC, id ASC"},
+		{"relevance", nil, "relevance DESC, id ASC"},
+		{"title", &Cursor{Sort: "title", Value: "a", ID: 1}, "title ASC, id ASC"},
+		{"title", &Cursor{Sort: "title", Value: "a", ID: 1, Prev: true}, "title DESC, id DESC"},
+		{"-year", &Cursor{Sort: "-year", Value: "2000", ID: 1, Prev: true}, "year ASC, id DESC"},
+	}
+
+	for _, tt := range tests {
+		f := Filters{Sort: tt.sort, SortSafeList: movieSorts, Cursor: tt.cursor}
+		if got := f.orderBy(); got != tt.want {
+			t.Errorf("sort %s, cursor %+v: got %q, want %q", tt.sort, tt.cursor, got, tt.want)
+		}
+	}
+}
+
+func TestKeyset(t *testing.T) {
+	tests := []struct {
+		name   string
+		sort   string
+		cursor *Cursor
+		want   string
+	}{
+		{"no cursor", "id", nil, "TRUE"},
+		{"ascending", "year", &Cursor{Sort: "year", Value: "2000", ID: 7}, "(year > $1 OR (year = $1 AND id > $2))"},
+		{"descending", "-year", &Cursor{Sort: "-year", Value: "2000", ID: 7}, "(year < $1 OR (year = $1 AND id > $2))"},
+		{"ascending backwards", "year", &Cursor{Sort: "year", Value: "2000", ID: 7, Prev: true}, "(year < $1 OR (year = $1 AND id < $2))"},
+		{"descending backwards", "-year", &Cursor{Sort: "-year", Value: "2000", ID: 7, Prev: true}, "(year > $1 OR (year = $1 AND id < $2))"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w Where
+
+			f := Filters{Sort: tt.sort, SortSafeList: movieSorts, Cursor: tt.cursor}
+			f.keyset(&w, f.sortColumn())
+
+			if got := w.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			if tt.cursor != nil {
+				want := []any{tt.cursor.Value, tt.cursor.ID}
+				if !reflect.DeepEqual(w.Args(), want) {
+					t.Errorf("got args %v, want %v", w.Args(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateFiltersCursor(t *testing.T) {
+	tests := []struct {
+		name  string
+		page  int
+		sort  string
+		valid bool
+	}{
+		{"matching sort", 1, "year", true},
+		{"different sort", 1, "-year", false},
+		{"with a page", 2, "year", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+
+			ValidateFilters(v, Filters{
+				Page:         tt.page,
+				PageSize:     20,
+				Sort:         tt.sort,
+				SortSafeList: movieSorts,
+				Cursor:       &Cursor{Sort: "year", Value: "2000", ID: 1},
+			})
+
+			if v.Valid() != tt.valid {
+				t.Errorf("got errors %v, want valid: %t", v.Errors, tt.valid)
+			}
+		})
+	}
+}
+
+type row struct {
+	id   int64
+	year string
+}
+
+func rows(ids ...int64) []row {
+	var r []row
+	for _, id := range ids {
+		r = append(r, row{id: id, year: "2000"})
+	}
+	return r
+}
+
+func TestCalculateCursorMetadata(t *testing.T) {
+	sortValue := func(r row) (string, int64) { return r.year, r.id }
+
+	tests := []struct {
+		name     string
+		rows     []row
+		filters  Filters
+		wantIDs  []int64
+		wantNext bool
+		wantPrev bool
+	}{
+		{
+			name:     "first page with more",
+			rows:     rows(1, 2, 3),
+			filters:  Filters{Page: 1, PageSize: 2, Sort: "year", SortSafeList: movieSorts},
+			wantIDs:  []int64{1, 2},
+			wantNext: true,
+		},
+		{
+			name:    "only page",
+			rows:    rows(1, 2),
+			filters: Filters{Page: 1, PageSize: 2, Sort: "year", SortSafeList: movieSorts},
+			wantIDs: []int64{1, 2},
+		},
+		{
+			name:     "second page by number",
+			rows:     rows(3),
+			filters:  Filters{Page: 2, PageSize: 2, Sort: "year", SortSafeList: movieSorts},
+			wantIDs:  []int64{3},
+			wantPrev: true,
+		},
+		{
+			name:     "after a cursor with more",
+			rows:     rows(3, 4, 5),
+			filters:  Filters{Page: 1, PageSize: 2, Sort: "year", SortSafeList: movieSorts, Cursor: &Cursor{Sort: "year", Value: "2000", ID: 2}},
+			wantIDs:  []int64{3, 4},
+			wantNext: true,
+			wantPrev: true,
+		},
+		{
+			name:     "before a cursor, reaching the start",
+			rows:     rows(2, 1),
+			filters:  Filters{Page: 1, PageSize: 2, Sort: "year", SortSafeList: movieSorts, Cursor: &Cursor{Sort: "year", Value: "2000", ID: 3, Prev: true}},
+			wantIDs:  []int64{1, 2},
+			wantNext: true,
+		},
+		{
+			name:     "before a cursor with more",
+			rows:     rows(4, 3, 2),
+			filters:  Filters{Page: 1, PageSize: 2, Sort: "year", SortSafeList: movieSorts, Cursor: &Cursor{Sort: "year", Value: "2000", ID: 5, Prev: true}},
+			wantIDs:  []int64{3, 4},
+			wantNext: true,
+			wantPrev: true,
+		},
+		{
+			name:    "empty",
+			rows:    nil,
+			filters: Filters{Page: 1, PageSize: 2, Sort: "year", SortSafeList: movieSorts},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, metadata := calculateCursorMetadata(tt.rows, 0, tt.filters, sortValue)
+
+			var ids []int64
+			for _, r := range got {
+				ids = append(ids, r.id)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("got ids %v, want %v", ids, tt.wantIDs)
+			}
+
+			if (metadata.NextCursor != "") != tt.wantNext {
+				t.Errorf("got next cursor %q, want one: %t", metadata.NextCursor, tt.wantNext)
+			}
+			if (metadata.PrevCursor != "") != tt.wantPrev {
+				t.Errorf("got prev cursor %q, want one: %t", metadata.PrevCursor, tt.wantPrev)
+			}
+
+			if metadata.NextCursor != "" {
+				next, err := DecodeCursor(metadata.NextCursor)
+				if err != nil || next.Prev || next.ID != tt.wantIDs[len(tt.wantIDs)-1] {
+					t.Errorf("got next cursor %+v (%v), want one after id %d", next, err, tt.wantIDs[len(tt.wantIDs)-1])
+				}
+			}
+			if metadata.PrevCursor != "" {
+				prev, err := DecodeCursor(metadata.PrevCursor)
+				if err != nil || !prev.Prev || prev.ID != tt.wantIDs[0] {
+					t.Errorf("got prev cursor %+v (%v), want one before id %d", prev, err, tt.wantIDs[0])
+				}
+			}
+		})
+	}
+}
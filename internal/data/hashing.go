@@ -0,0 +1,188 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+// PasswordHasher creates password hashes with one algorithm and set of parameters. The
+// hashes it creates are self-describing, so that any stored hash can be checked no
+// matter which hasher is configured now.
+type PasswordHasher interface {
+	Hash(plaintext string) ([]byte, error)
+	// NeedsRehash reports whether a hash was made with a different algorithm or with
+	// weaker parameters than this hasher uses.
+	NeedsRehash(hash []byte) bool
+	// MaxLength is the longest password in bytes that the algorithm can hash.
+	MaxLength() int
+}
+
+// passwordHasher is used for all new hashes. It defaults to argon2id with the
+// parameters recommended in RFC 9106 for memory constrained environments.
+var passwordHasher PasswordHasher = Argon2idHasher{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// SetPasswordHasher changes the hasher used for new password hashes. It should be
+// called once at startup.
+func SetPasswordHasher(hasher PasswordHasher) {
+	passwordHasher = hasher
+}
+
+// compareHashAndPassword checks a password against a hash made by any of the
+// supported algorithms.
+func compareHashAndPassword(hash []byte, plaintext string) (bool, error) {
+	switch {
+	case strings.HasPrefix(string(hash), "$argon2id$"):
+		return compareArgon2id(hash, plaintext)
+	case isBcryptHash(hash):
+		err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+		if err != nil {
+			switch {
+			case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+		return true, nil
+	default:
+		return false, ErrUnknownHashFormat
+	}
+}
+
+// Argon2idHasher hashes passwords with argon2id, encoding them in the PHC string
+// format: $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+func (h Argon2idHasher) Hash(plaintext string) ([]byte, error) {
+	salt := make([]byte, h.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	encoded := fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Memory,
+		h.Iterations,
+		h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+	return []byte(encoded), nil
+}
+
+func (h Argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, _, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory < h.Memory ||
+		params.Iterations < h.Iterations ||
+		params.Parallelism < h.Parallelism ||
+		uint32(len(key)) < h.KeyLength
+}
+
+// argon2id has no practical limit, this just stops huge inputs being used to tie up
+// the server.
+func (h Argon2idHasher) MaxLength() int {
+	return 1024
+}
+
+func decodeArgon2id(hash []byte) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	var params Argon2idHasher
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return &params, salt, key, nil
+}
+
+func compareArgon2id(hash []byte, plaintext string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+// BcryptHasher hashes passwords with bcrypt, whose hashes already record their
+// version and cost.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plaintext string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintext), h.Cost)
+}
+
+func (h BcryptHasher) NeedsRehash(hash []byte) bool {
+	if !isBcryptHash(hash) {
+		return true
+	}
+
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost < h.Cost
+}
+
+// bcrypt ignores anything after the first 72 bytes of a password
+func (h BcryptHasher) MaxLength() int {
+	return 72
+}
+
+func isBcryptHash(hash []byte) bool {
+	s := string(hash)
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
@@ -0,0 +1,109 @@
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap parameters, so that the tests don't take long
+var testArgon2id = Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func mustHash(t *testing.T, hasher PasswordHasher, plaintext string) []byte {
+	t.Helper()
+
+	hash, err := hasher.Hash(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestCompareHashAndPassword(t *testing.T) {
+	argon2idHash := mustHash(t, testArgon2id, "pa55word")
+	bcryptHash := mustHash(t, BcryptHasher{Cost: bcrypt.MinCost}, "pa55word")
+
+	tests := []struct {
+		name      string
+		hash      []byte
+		plaintext string
+		want      bool
+		wantErr   error
+	}{
+		{"argon2id match", argon2idHash, "pa55word", true, nil},
+		{"argon2id mismatch", argon2idHash, "wrong", false, nil},
+		{"bcrypt match", bcryptHash, "pa55word", true, nil},
+		{"bcrypt mismatch", bcryptHash, "wrong", false, nil},
+		{"unknown format", []byte("$md5$abc"), "pa55word", false, ErrUnknownHashFormat},
+		{"malformed argon2id", []byte("$argon2id$v=19$m=64$salt$key"), "pa55word", false, ErrUnknownHashFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := compareHashAndPassword(tt.hash, tt.plaintext)
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("got (%t, %v), want (%t, %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	hash := mustHash(t, testArgon2id, "pa55word")
+
+	with := func(change func(h *Argon2idHasher)) Argon2idHasher {
+		h := testArgon2id
+		change(&h)
+		return h
+	}
+
+	tests := []struct {
+		name   string
+		hasher Argon2idHasher
+		hash   []byte
+		want   bool
+	}{
+		{"same parameters", testArgon2id, hash, false},
+		{"weaker parameters", with(func(h *Argon2idHasher) { h.Memory = 32 }), hash, false},
+		{"more memory", with(func(h *Argon2idHasher) { h.Memory = 128 }), hash, true},
+		{"more iterations", with(func(h *Argon2idHasher) { h.Iterations = 2 }), hash, true},
+		{"more parallelism", with(func(h *Argon2idHasher) { h.Parallelism = 2 }), hash, true},
+		{"longer key", with(func(h *Argon2idHasher) { h.KeyLength = 64 }), hash, true},
+		{"bcrypt hash", testArgon2id, mustHash(t, BcryptHasher{Cost: bcrypt.MinCost}, "pa55word"), true},
+		{"garbage", testArgon2id, []byte("garbage"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.NeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBcryptNeedsRehash(t *testing.T) {
+	hash := mustHash(t, BcryptHasher{Cost: bcrypt.MinCost}, "pa55word")
+
+	tests := []struct {
+		name   string
+		hasher BcryptHasher
+		hash   []byte
+		want   bool
+	}{
+		{"same cost", BcryptHasher{Cost: bcrypt.MinCost}, hash, false},
+		{"lower cost", BcryptHasher{Cost: bcrypt.MinCost - 1}, hash, false},
+		{"higher cost", BcryptHasher{Cost: bcrypt.MinCost + 1}, hash, true},
+		{"argon2id hash", BcryptHasher{Cost: bcrypt.MinCost}, mustHash(t, testArgon2id, "pa55word"), true},
+		{"malformed bcrypt", BcryptHasher{Cost: bcrypt.MinCost}, []byte("$2a$xx$"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.NeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
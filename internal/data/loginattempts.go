@@ -0,0 +1,151 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// LoginStatus summarises the recent failed login attempts for an email address and
+// for the IP address a login is coming from.
+type LoginStatus struct {
+	EmailFailures    int
+	LastEmailFailure time.Time
+	IPFailures       int
+	LastIPFailure    time.Time
+	LockedUntil      time.Time
+}
+
+// LoginAttempt is a failed login recorded against an email address.
+type LoginAttempt struct {
+	IPAddress string    `json:"ip_address"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+// Status returns the failed attempts since the given time, along with any lockout on
+// the email address that hasn't expired yet.
+func (m LoginAttemptModel) Status(email, ipAddress string, since time.Time) (*LoginStatus, error) {
+	query := `
+	SELECT
+		count(*) FILTER (WHERE email = $1),
+		COALESCE(max(created_at) FILTER (WHERE email = $1), 'epoch'),
+		count(*) FILTER (WHERE ip_address = $2),
+		COALESCE(max(created_at) FILTER (WHERE ip_address = $2), 'epoch'),
+		COALESCE((SELECT locked_until FROM login_lockouts WHERE email = $1 AND locked_until > NOW()), 'epoch')
+	FROM login_attempts
+	WHERE (email = $1 OR ip_address = $2) AND created_at > $3
+	`
+
+	var status LoginStatus
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, email, ipAddress, since).Scan(
+		&status.EmailFailures,
+		&status.LastEmailFailure,
+		&status.IPFailures,
+		&status.LastIPFailure,
+		&status.LockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (m LoginAttemptModel) RecordFailure(email, ipAddress string) error {
+	query := `
+	INSERT INTO login_attempts (email, ip_address)
+	VALUES ($1, $2)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email, ipAddress)
+	return err
+}
+
+// Lock stops any logins for the email address until the given time.
+func (m LoginAttemptModel) Lock(email string, until time.Time) error {
+	query := `
+	INSERT INTO login_lockouts (email, locked_until)
+	VALUES ($1, $2)
+	ON CONFLICT (email) DO UPDATE SET locked_until = EXCLUDED.locked_until
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email, until)
+	return err
+}
+
+// Clear forgets the failed attempts for an email address after a successful login.
+func (m LoginAttemptModel) Clear(email string) error {
+	query := `
+	DELETE FROM login_attempts WHERE email = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email)
+	return err
+}
+
+// DeleteExpired removes attempts and lockouts that no longer count towards anything.
+func (m LoginAttemptModel) DeleteExpired(before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM login_attempts WHERE created_at < $1`, before)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM login_lockouts WHERE locked_until < NOW()`)
+	return err
+}
+
+func (m LoginAttemptModel) GetAllForEmail(email string) ([]*LoginAttempt, error) {
+	query := `
+	SELECT ip_address, created_at
+	FROM login_attempts
+	WHERE email = $1
+	ORDER BY created_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []*LoginAttempt{}
+
+	for rows.Next() {
+		var attempt LoginAttempt
+
+		err := rows.Scan(&attempt.IPAddress, &attempt.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		attempts = append(attempts, &attempt)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
@@ -11,17 +11,31 @@ var (
 )
 
 type Models struct {
-	Movies      MovieModel
-	Token       TokenModel
-	Users       UserModel
-	Permissions PermissionModel
+	APIKeys       APIKeyModel
+	Collaborators CollaboratorModel
+	Logins        LoginAttemptModel
+	Movies        MovieModel
+	Revisions     MovieRevisionModel
+	Token         TokenModel
+	Users         UserModel
+	Permissions   PermissionModel
+	Roles         RoleModel
+	TOTP          TOTPModel
 }
 
 func NewModels(db *sql.DB) Models {
+	permissionCache := newPermissionCache()
+
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Token:       TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db},
+		Collaborators: CollaboratorModel{DB: db},
+		Logins:        LoginAttemptModel{DB: db},
+		Movies:        MovieModel{DB: db},
+		Revisions:     MovieRevisionModel{DB: db},
+		Permissions:   PermissionModel{DB: db, cache: permissionCache},
+		Roles:         RoleModel{DB: db, permissions: permissionCache},
+		Token:         TokenModel{DB: db},
+		TOTP:          TOTPModel{DB: db},
+		Users:         UserModel{DB: db},
 	}
 }
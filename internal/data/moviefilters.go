@@ -0,0 +1,111 @@
+package data
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.temideewan.net/internal/validator"
+)
+
+// MovieFilters narrows down the movies listed by GetAll. Zero values are ignored.
+type MovieFilters struct {
+	Title string
+	// the text search configuration the title is searched with, one of
+	// SearchLanguages. It defaults to simple.
+	Language string
+	// whether titles similar to Title match as well as ones containing its words
+	Fuzzy bool
+	// movies must have all of Genres, at least one of AnyGenres and none of
+	// ExcludeGenres
+	Genres        []string
+	AnyGenres     []string
+	ExcludeGenres []string
+	YearMin       int32
+	YearMax       int32
+	RuntimeMin    Runtime
+	RuntimeMax    Runtime
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+func ValidateMovieFilters(v *validator.Validator, f MovieFilters) {
+	v.Check(len(f.Title) <= 500, "title", "must not be more than 500 bytes long")
+	if f.Language != "" {
+		v.Check(validator.PermittedValue(f.Language, SearchLanguages...), "language", "must be one of "+strings.Join(SearchLanguages, ", "))
+	}
+
+	v.Check(len(f.Genres) <= 20, "genres", "must not contain more than 20 genres")
+	v.Check(len(f.AnyGenres) <= 20, "genres_any", "must not contain more than 20 genres")
+	v.Check(len(f.ExcludeGenres) <= 20, "genres_exclude", "must not contain more than 20 genres")
+
+	v.Check(f.YearMin >= 0, "year_min", "must not be negative")
+	v.Check(f.YearMax >= 0, "year_max", "must not be negative")
+	if f.YearMin != 0 && f.YearMax != 0 {
+		v.Check(f.YearMin <= f.YearMax, "year_min", "must not be greater than year_max")
+	}
+
+	v.Check(f.RuntimeMin >= 0, "runtime_min", "must not be negative")
+	v.Check(f.RuntimeMax >= 0, "runtime_max", "must not be negative")
+	if f.RuntimeMin != 0 && f.RuntimeMax != 0 {
+		v.Check(f.RuntimeMin <= f.RuntimeMax, "runtime_min", "must not be greater than runtime_max")
+	}
+
+	if !f.CreatedAfter.IsZero() && !f.CreatedBefore.IsZero() {
+		v.Check(f.CreatedAfter.Before(f.CreatedBefore), "created_after", "must be before created_before")
+	}
+}
+
+// where adds the conditions for the filters, along with the one hiding movies in the
+// trash. It returns the title search, which is nil when there isn't one.
+func (f MovieFilters) where(w *Where) *titleSearch {
+	w.Add("deleted_at IS NULL")
+
+	var search *titleSearch
+
+	// a title that is all spaces wouldn't give the search any words to look for
+	if strings.TrimSpace(f.Title) != "" {
+		language := f.Language
+		if language == "" {
+			language = "simple"
+		}
+
+		s := newTitleSearch(w, language, f.Title, f.Fuzzy)
+		search = &s
+
+		w.Add(search.match())
+	}
+
+	if len(f.Genres) > 0 {
+		w.Add("genres @> ?", pq.Array(f.Genres))
+	}
+	if len(f.AnyGenres) > 0 {
+		w.Add("genres && ?", pq.Array(f.AnyGenres))
+	}
+	if len(f.ExcludeGenres) > 0 {
+		w.Add("NOT genres && ?", pq.Array(f.ExcludeGenres))
+	}
+
+	if f.YearMin != 0 {
+		w.Add("year >= ?", f.YearMin)
+	}
+	if f.YearMax != 0 {
+		w.Add("year <= ?", f.YearMax)
+	}
+
+	if f.RuntimeMin != 0 {
+		w.Add("runtime >= ?", f.RuntimeMin)
+	}
+	if f.RuntimeMax != 0 {
+		w.Add("runtime <= ?", f.RuntimeMax)
+	}
+
+	if !f.CreatedAfter.IsZero() {
+		w.Add("created_at > ?", f.CreatedAfter)
+	}
+	if !f.CreatedBefore.IsZero() {
+		w.Add("created_at < ?", f.CreatedBefore)
+	}
+
+	return search
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/lib/pq"
@@ -12,13 +13,18 @@ import (
 )
 
 type Movie struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitzero"`
-	Runtime   Runtime   `json:"runtime,omitzero"`
-	Genres    []string  `json:"genres,omitzero"`
-	Version   int32     `json:"version"`
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"-"`
+	Title     string     `json:"title"`
+	Year      int32      `json:"year,omitzero"`
+	Runtime   Runtime    `json:"runtime,omitzero"`
+	Genres    []string   `json:"genres,omitzero"`
+	CreatedBy *int64     `json:"created_by,omitzero"`
+	DeletedAt *time.Time `json:"deleted_at,omitzero"`
+	Version   int32      `json:"version"`
+	// set when listing movies with a title search
+	Relevance  float32     `json:"relevance,omitzero"`
+	Highlights []Highlight `json:"highlights,omitzero"`
 }
 
 func ValidateMovie(v *validator.Validator, m *Movie) {
@@ -43,16 +49,36 @@ type MovieModel struct {
 	DB *sql.DB
 }
 
-// insert a new record into the movies table
+// insert a new record into the movies table, recording it as the first revision
 func (m MovieModel) Insert(movie *Movie) error {
 	query := `
-	INSERT INTO MOVIES (title, year, runtime, genres)
-	VALUES($1,$2,$3,$4)
+	INSERT INTO MOVIES (title, year, runtime, genres, created_by)
+	VALUES($1,$2,$3,$4,$5)
 	RETURNING id, created_at, version
 	`
 
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
-	return m.DB.QueryRow(query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	if err != nil {
+		return err
+	}
+
+	err = insertRevision(ctx, tx, movie, movie.CreatedBy)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // fetch a specific record from the movies
@@ -61,9 +87,9 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		return nil, ErrRecordNotFound
 	}
 	query := `
-	SELECT id, created_at, title, year, runtime, genres, version
+	SELECT id, created_at, title, year, runtime, genres, created_by, version
 	FROM movies
-	WHERE id = $1
+	WHERE id = $1 AND deleted_at IS NULL
 	`
 	var movie Movie
 
@@ -77,6 +103,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
+		&movie.CreatedBy,
 		&movie.Version,
 	)
 
@@ -91,19 +118,27 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-// update a record in the movies table
-func (m MovieModel) Update(movie *Movie) error {
+// update a record in the movies table, recording the new version as a revision made
+// by the given user
+func (m MovieModel) Update(movie *Movie, userID int64) error {
 	query := `
 		UPDATE movies
 		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		WHERE id = $5 AND version = $6 AND deleted_at IS NULL
 		RETURNING version
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ID, movie.Version}
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -112,43 +147,262 @@ func (m MovieModel) Update(movie *Movie) error {
 			return err
 		}
 	}
-	return nil
-}
 
-// delete a record from the movies table
-func (m MovieModel) Delete(id int64) error {
-	if id < 1 {
-		return ErrRecordNotFound
+	err = insertRevision(ctx, tx, movie, &userID)
+	if err != nil {
+		return err
 	}
+
+	return tx.Commit()
+}
+
+// move a record to the trash. It stays in the movies table, hidden from everything
+// but the trash, until it is restored or purged. Like an update this makes a new
+// version, recorded as a revision by the given user, so that clients holding the old
+// version see the change. It fails with ErrEditConflict if the movie has changed since
+// it was read.
+func (m MovieModel) Delete(movie *Movie, userID int64) error {
 	query := `
-	DELETE FROM movies
-	WHERE id=$1
+	UPDATE movies
+	SET deleted_at = NOW(), version = version + 1
+	WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+	RETURNING deleted_at, version
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
-	result, err := m.DB.ExecContext(ctx, query, id)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	err = tx.QueryRowContext(ctx, query, movie.ID, movie.Version).Scan(&movie.DeletedAt, &movie.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
 
+	err = insertRevision(ctx, tx, movie, &userID)
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	return tx.Commit()
+}
+
+// GetAll lists the movies matching the filters, a page at a time. Pages can be picked
+// by number or by a cursor from a previous page, and either way the metadata includes
+// cursors for the pages either side.
+func (m MovieModel) GetAll(movieFilters MovieFilters, filters Filters) ([]*Movie, Metadata, error) {
+	var where Where
+
+	search := movieFilters.where(&where)
+
+	relevance, headline := "0", "''"
+	if search != nil {
+		relevance, headline = search.rank(), search.headline()
 	}
-	return nil
+
+	// count(*) over() counts the rows before the keyset condition is applied, so with
+	// a cursor the total needs a subquery of its own.
+	total := "0"
+
+	if filters.IncludeTotal {
+		if filters.Cursor == nil {
+			total = "count(*) over()"
+		} else {
+			total = fmt.Sprintf("(SELECT count(*) FROM movies WHERE %s)", where.String())
+		}
+	}
+
+	column := filters.sortColumn()
+	if column == "relevance" {
+		column = relevance
+	}
+
+	filters.keyset(&where, column)
+
+	// fetch one extra row to find out whether there's another page
+	limit := where.Param(filters.limit() + 1)
+	offset := where.Param(filters.offset())
+
+	query := fmt.Sprintf(`
+		SELECT %s, id, created_at, title, year, runtime, genres, created_by, version,
+			%s AS relevance, %s
+		FROM movies
+		WHERE %s
+		ORDER BY %s
+		LIMIT %s OFFSET %s
+	`, total, relevance, headline, where.String(), filters.orderBy(), limit, offset)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, where.Args()...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var (
+			movie  Movie
+			marked string
+		)
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.CreatedBy,
+			&movie.Version,
+			&movie.Relevance,
+			&marked,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		movie.Highlights = highlights(marked)
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	movies, metaData := calculateCursorMetadata(movies, totalRecords, filters, func(movie *Movie) (string, int64) {
+		return movie.sortValue(filters.sortColumn()), movie.ID
+	})
+	return movies, metaData, nil
+}
+
+// sortValue returns the movie's value in a sort column, for use in a cursor
+func (movie *Movie) sortValue(column string) string {
+	switch column {
+	case "title":
+		return movie.Title
+	case "year":
+		return strconv.Itoa(int(movie.Year))
+	case "runtime":
+		return strconv.Itoa(int(movie.Runtime))
+	case "relevance":
+		return strconv.FormatFloat(float64(movie.Relevance), 'g', -1, 32)
+	default:
+		return strconv.FormatInt(movie.ID, 10)
+	}
+}
+
+// list the movies a user created, including the ones in the trash, for their data
+// export
+func (m MovieModel) GetAllForCreator(userID int64) ([]*Movie, error) {
+	query := `
+	SELECT id, created_at, title, year, runtime, genres, created_by, deleted_at, version
+	FROM movies
+	WHERE created_by = $1
+	ORDER BY id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.CreatedBy,
+			&movie.DeletedAt,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// fetch a specific record from the trash
+func (m MovieModel) GetDeleted(id int64) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+	SELECT id, created_at, title, year, runtime, genres, created_by, deleted_at, version
+	FROM movies
+	WHERE id = $1 AND deleted_at IS NOT NULL
+	`
+	var movie Movie
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.CreatedBy,
+		&movie.DeletedAt,
+		&movie.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &movie, nil
+}
+
+// list the movies in the trash which the given user could edit, or every movie in
+// the trash if all is true.
+func (m MovieModel) GetAllDeleted(userID int64, all bool, filters Filters) ([]*Movie, Metadata, error) {
 	query := fmt.Sprintf(`
-		SELECT count(*) over(), id, created_at, title, year, runtime, genres, version
+		SELECT count(*) over(), id, created_at, title, year, runtime, genres, created_by, deleted_at, version
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres @> $2 OR $2 = '{}')
+		WHERE deleted_at IS NOT NULL
+		AND (
+			$2
+			OR created_by = $1
+			OR EXISTS (SELECT 1 FROM movie_collaborators mc WHERE mc.movie_id = movies.id AND mc.user_id = $1)
+		)
 		ORDER BY %s %s, id ASC
 		LIMIT $3 OFFSET $4
 	`, filters.sortColumn(), filters.sortDirection())
@@ -156,7 +410,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []any{userID, all, filters.limit(), filters.offset()}
 
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -179,6 +433,8 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			&movie.CreatedBy,
+			&movie.DeletedAt,
 			&movie.Version,
 		)
 		if err != nil {
@@ -193,3 +449,91 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	metaData := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
 	return movies, metaData, nil
 }
+
+// take a record back out of the trash, recording the new version as a revision by the
+// given user
+func (m MovieModel) Restore(movie *Movie, userID int64) error {
+	query := `
+		UPDATE movies
+		SET deleted_at = NULL, version = version + 1
+		WHERE id = $1 AND version = $2 AND deleted_at IS NOT NULL
+		RETURNING version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, movie.ID, movie.Version).Scan(&movie.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = insertRevision(ctx, tx, movie, &userID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	movie.DeletedAt = nil
+	return nil
+}
+
+// permanently delete a record that is in the trash
+func (m MovieModel) Purge(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+	DELETE FROM movies
+	WHERE id = $1 AND deleted_at IS NOT NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// permanently delete every record that was moved to the trash before the given time,
+// returning how many there were.
+func (m MovieModel) PurgeDeletedBefore(before time.Time) (int64, error) {
+	query := `
+	DELETE FROM movies
+	WHERE deleted_at IS NOT NULL AND deleted_at < $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
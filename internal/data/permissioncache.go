@@ -0,0 +1,135 @@
+package data
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// permissionCache holds users' permissions in memory for a short while, so that
+// requirePermission doesn't have to hit the database on every request. A zero ttl
+// disables it. It is shared by every copy of the models that can change a user's
+// permissions, which invalidate the entries they affect.
+//
+// Each invalidation also bumps the user's generation. A lookup records the generation
+// before reading the database and only caches what it read if the generation hasn't
+// changed, so a read that raced with a change can't put the old permissions back.
+type permissionCache struct {
+	mu          sync.RWMutex
+	ttl         time.Duration
+	entries     map[int64]permissionCacheEntry
+	generations map[int64]uint64
+	hits        atomic.Int64
+	misses      atomic.Int64
+}
+
+type permissionCacheEntry struct {
+	permissions Permissions
+	expiry      time.Time
+}
+
+type PermissionCacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+func newPermissionCache() *permissionCache {
+	return &permissionCache{
+		entries:     make(map[int64]permissionCacheEntry),
+		generations: make(map[int64]uint64),
+	}
+}
+
+func (c *permissionCache) get(userID int64) (Permissions, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[userID]
+	enabled := c.ttl > 0
+	c.mu.RUnlock()
+
+	if !enabled {
+		return nil, false
+	}
+
+	if !ok || time.Now().After(entry.expiry) {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	return entry.permissions, true
+}
+
+// generation returns the user's current generation, to be passed to set once their
+// permissions have been read.
+func (c *permissionCache) generation(userID int64) uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.generations[userID]
+}
+
+// set caches the user's permissions, unless they were invalidated after generation
+// was read.
+func (c *permissionCache) set(userID int64, generation uint64, permissions Permissions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl <= 0 || c.generations[userID] != generation {
+		return
+	}
+
+	// clip the slice so that a caller appending to a cached value can't write into
+	// the backing array other requests are reading.
+	c.entries[userID] = permissionCacheEntry{permissions: slices.Clip(permissions), expiry: time.Now().Add(c.ttl)}
+}
+
+func (c *permissionCache) delete(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, userID)
+
+	// the generation outlives the entry, since resetting it could let a lookup that
+	// started earlier match it again.
+	c.generations[userID]++
+}
+
+// drop entries that have expired, returning how many were removed
+func (c *permissionCache) prune() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	now := time.Now()
+
+	for userID, entry := range c.entries {
+		if now.After(entry.expiry) {
+			delete(c.entries, userID)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *permissionCache) setTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+	if ttl <= 0 {
+		clear(c.entries)
+	}
+}
+
+func (c *permissionCache) stats() PermissionCacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return PermissionCacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: len(c.entries),
+	}
+}
@@ -0,0 +1,51 @@
+package data
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPermissionCacheSet(t *testing.T) {
+	cache := newPermissionCache()
+	cache.setTTL(time.Minute)
+
+	generation := cache.generation(1)
+	cache.set(1, generation, Permissions{"movies:read"})
+
+	got, ok := cache.get(1)
+	if !ok || !slices.Equal(got, Permissions{"movies:read"}) {
+		t.Errorf("got %v, %v; want [movies:read], true", got, ok)
+	}
+}
+
+func TestPermissionCacheSetAfterDelete(t *testing.T) {
+	cache := newPermissionCache()
+	cache.setTTL(time.Minute)
+
+	// a lookup records the generation, then the user's permissions change before it
+	// gets to store what it read.
+	generation := cache.generation(1)
+	cache.delete(1)
+	cache.set(1, generation, Permissions{"movies:read", "movies:write"})
+
+	if got, ok := cache.get(1); ok {
+		t.Errorf("cached %v read before the permissions changed", got)
+	}
+
+	cache.set(1, cache.generation(1), Permissions{"movies:read"})
+
+	if _, ok := cache.get(1); !ok {
+		t.Error("permissions read after the change weren't cached")
+	}
+}
+
+func TestPermissionCacheDisabled(t *testing.T) {
+	cache := newPermissionCache()
+
+	cache.set(1, cache.generation(1), Permissions{"movies:read"})
+
+	if got, ok := cache.get(1); ok {
+		t.Errorf("got %v from a disabled cache", got)
+	}
+}
@@ -16,17 +16,71 @@ func (p Permissions) Include(code string) bool {
 	return slices.Contains(p, code)
 }
 
+// helper method returning the permissions that are in both p and other
+func (p Permissions) Intersect(other Permissions) Permissions {
+	var permissions Permissions
+
+	for _, code := range p {
+		if other.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+	return permissions
+}
+
 type PermissionModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	cache *permissionCache
+}
+
+// SetCacheTTL sets how long a user's permissions are cached for. Zero disables the
+// cache.
+func (m PermissionModel) SetCacheTTL(ttl time.Duration) {
+	m.cache.setTTL(ttl)
 }
 
+func (m PermissionModel) CacheStats() PermissionCacheStats {
+	return m.cache.stats()
+}
+
+// PruneCache drops expired entries from the permission cache, returning how many
+// were removed.
+func (m PermissionModel) PruneCache() int {
+	return m.cache.prune()
+}
+
+// GetAllForUser returns the user's permissions, from the cache if they were looked
+// up recently.
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	if permissions, ok := m.cache.get(userID); ok {
+		return permissions, nil
+	}
+
+	generation := m.cache.generation(userID)
+
+	permissions, err := m.getAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	m.cache.set(userID, generation, permissions)
+	return permissions, nil
+}
+
+func (m PermissionModel) getAllForUser(userID int64) (Permissions, error) {
+	// a user's permissions are the ones granted to them directly, plus the ones that
+	// come from their roles.
 	query := `
 	SELECT p.code
 	FROM permissions p
 	INNER JOIN users_permissions up ON up.permission_id = p.id
-	INNER JOIN users u on up.user_id = u.id
-	WHERE u.id = $1
+	WHERE up.user_id = $1
+	UNION
+	SELECT p.code
+	FROM permissions p
+	INNER JOIN role_permissions rp ON rp.permission_id = p.id
+	INNER JOIN users_roles ur ON ur.role_id = rp.role_id
+	WHERE ur.user_id = $1
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -57,14 +111,76 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, err
 }
 
+// list every permission code that can be granted
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `
+	SELECT code
+	FROM permissions
+	ORDER BY code
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
 func (m PermissionModel) AddForUser(userId int64, codes ...string) error {
 	query := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userId, pq.Array(codes))
-	return err
+	if err != nil {
+		return err
+	}
+
+	m.cache.delete(userId)
+	return nil
+}
+
+// revoke permissions granted directly to a user. Permissions that come from the
+// user's roles are left alone.
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+		DELETE FROM users_permissions
+		WHERE user_id = $1
+		AND permission_id IN (SELECT id FROM permissions WHERE code = ANY($2))
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	m.cache.delete(userID)
+	return nil
 }
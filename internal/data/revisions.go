@@ -0,0 +1,197 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MovieRevision is a movie as it was at one of its versions
+type MovieRevision struct {
+	MovieID   int64     `json:"movie_id"`
+	Version   int32     `json:"version"`
+	Title     string    `json:"title"`
+	Year      int32     `json:"year"`
+	Runtime   Runtime   `json:"runtime"`
+	Genres    []string  `json:"genres"`
+	ChangedBy *int64    `json:"changed_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FieldChange is one field that differs between two revisions of a movie
+type FieldChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// Diff lists the fields that changed between r and other, in the order they appear in
+// a movie.
+func (r *MovieRevision) Diff(other *MovieRevision) []FieldChange {
+	changes := []FieldChange{}
+
+	if r.Title != other.Title {
+		changes = append(changes, FieldChange{"title", r.Title, other.Title})
+	}
+	if r.Year != other.Year {
+		changes = append(changes, FieldChange{"year", r.Year, other.Year})
+	}
+	if r.Runtime != other.Runtime {
+		changes = append(changes, FieldChange{"runtime", r.Runtime, other.Runtime})
+	}
+	if !slices.Equal(r.Genres, other.Genres) {
+		changes = append(changes, FieldChange{"genres", r.Genres, other.Genres})
+	}
+
+	return changes
+}
+
+// insertRevision records the current state of a movie, within the transaction that
+// changed it.
+func insertRevision(ctx context.Context, tx *sql.Tx, movie *Movie, changedBy *int64) error {
+	query := `
+	INSERT INTO movie_revisions (movie_id, version, title, year, runtime, genres, changed_by)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	args := []any{movie.ID, movie.Version, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), changedBy}
+
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+type MovieRevisionModel struct {
+	DB *sql.DB
+}
+
+// list every revision of a movie, newest first
+func (m MovieRevisionModel) GetAllForMovie(movieID int64) ([]*MovieRevision, error) {
+	query := `
+	SELECT movie_id, version, title, year, runtime, genres, changed_by, created_at
+	FROM movie_revisions
+	WHERE movie_id = $1
+	ORDER BY version DESC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []*MovieRevision{}
+
+	for rows.Next() {
+		var revision MovieRevision
+
+		err := rows.Scan(
+			&revision.MovieID,
+			&revision.Version,
+			&revision.Title,
+			&revision.Year,
+			&revision.Runtime,
+			pq.Array(&revision.Genres),
+			&revision.ChangedBy,
+			&revision.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		revisions = append(revisions, &revision)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// list the revisions the user made to any movie, newest first
+func (m MovieRevisionModel) GetAllForUser(userID int64) ([]*MovieRevision, error) {
+	query := `
+	SELECT movie_id, version, title, year, runtime, genres, changed_by, created_at
+	FROM movie_revisions
+	WHERE changed_by = $1
+	ORDER BY created_at DESC, movie_id, version DESC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []*MovieRevision{}
+
+	for rows.Next() {
+		var revision MovieRevision
+
+		err := rows.Scan(
+			&revision.MovieID,
+			&revision.Version,
+			&revision.Title,
+			&revision.Year,
+			&revision.Runtime,
+			pq.Array(&revision.Genres),
+			&revision.ChangedBy,
+			&revision.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		revisions = append(revisions, &revision)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+func (m MovieRevisionModel) Get(movieID int64, version int32) (*MovieRevision, error) {
+	query := `
+	SELECT movie_id, version, title, year, runtime, genres, changed_by, created_at
+	FROM movie_revisions
+	WHERE movie_id = $1 AND version = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var revision MovieRevision
+
+	err := m.DB.QueryRowContext(ctx, query, movieID, version).Scan(
+		&revision.MovieID,
+		&revision.Version,
+		&revision.Title,
+		&revision.Year,
+		&revision.Runtime,
+		pq.Array(&revision.Genres),
+		&revision.ChangedBy,
+		&revision.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &revision, nil
+}
@@ -0,0 +1,234 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.temideewan.net/internal/validator"
+)
+
+var (
+	ErrDuplicateRoleName = errors.New("duplicate role name")
+	ErrUnknownPermission = errors.New("unknown permission")
+)
+
+var (
+	RoleNameRX = regexp.MustCompile(`^[a-z0-9_-]+$`)
+)
+
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+func ValidateRole(v *validator.Validator, role *Role) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Matches(role.Name, RoleNameRX), "name", "must only contain lowercase letters, numbers, dashes and underscores")
+
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+}
+
+type RoleModel struct {
+	DB *sql.DB
+	// the permission cache, so that changing a user's roles invalidates it
+	permissions *permissionCache
+}
+
+// insert a role along with the permissions it grants. ErrUnknownPermission is
+// returned if any of the permission codes don't exist.
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `INSERT INTO roles (name) VALUES ($1) RETURNING id`, role.Name).Scan(&role.ID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		default:
+			return err
+		}
+	}
+
+	query := `
+	INSERT INTO role_permissions
+	SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+	`
+
+	result, err := tx.ExecContext(ctx, query, role.ID, pq.Array(role.Permissions))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected != int64(len(role.Permissions)) {
+		return ErrUnknownPermission
+	}
+
+	return tx.Commit()
+}
+
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+	SELECT r.id, r.name, COALESCE(array_agg(p.code ORDER BY p.code) FILTER (WHERE p.code IS NOT NULL), '{}')
+	FROM roles r
+	LEFT JOIN role_permissions rp ON rp.role_id = r.id
+	LEFT JOIN permissions p ON p.id = rp.permission_id
+	GROUP BY r.id
+	ORDER BY r.id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(&role.ID, &role.Name, pq.Array(&role.Permissions))
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// list the names of the roles assigned to a user
+func (m RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	query := `
+	SELECT r.name
+	FROM roles r
+	INNER JOIN users_roles ur ON ur.role_id = r.id
+	WHERE ur.user_id = $1
+	ORDER BY r.name
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+
+	for rows.Next() {
+		var name string
+
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// assign a role to a user, returning ErrRecordNotFound if there is no role with that
+// name. Assigning a role the user already has is not an error.
+func (m RoleModel) AssignToUser(userID int64, name string) error {
+	query := `
+	INSERT INTO users_roles
+	SELECT $1, roles.id FROM roles WHERE roles.name = $2
+	ON CONFLICT DO NOTHING
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, name)
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+
+	err = m.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`, name).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return ErrRecordNotFound
+	}
+
+	m.permissions.delete(userID)
+	return nil
+}
+
+// Exists reports whether there is a role with the given name
+func (m RoleModel) Exists(name string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`, name).Scan(&exists)
+	return exists, err
+}
+
+func (m RoleModel) RemoveFromUser(userID int64, name string) error {
+	query := `
+	DELETE FROM users_roles
+	WHERE user_id = $1 AND role_id = (SELECT id FROM roles WHERE name = $2)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	m.permissions.delete(userID)
+	return nil
+}
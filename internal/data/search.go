@@ -0,0 +1,189 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SearchLanguages are the text search configurations titles can be searched with.
+// Each one has an index on to_tsvector(language, title), and since the name ends up
+// in the SQL rather than a placeholder (so that the index can be used) only these are
+// allowed.
+var SearchLanguages = []string{"simple", "english", "french", "german", "spanish"}
+
+// titleSearch is a full-text search of the movie titles
+type titleSearch struct {
+	language string
+	query    string
+	// placeholder for the search as typed, when titles that are only similar to it
+	// match too
+	fuzzy string
+}
+
+// newTitleSearch parses a search in the websearch_to_tsquery syntax, which supports
+// "quoted phrases", OR and -excluded words, with the addition of prefix matches for
+// words ending in *. The tsquery arguments are added to w, and language must be one of
+// SearchLanguages. With fuzzy set, titles containing words similar to the search
+// match as well, so that typos still find something.
+func newTitleSearch(w *Where, language, search string, fuzzy bool) titleSearch {
+	var (
+		words    []string
+		prefixes []string
+		quoted   bool
+	)
+
+	for word := range strings.FieldsSeq(search) {
+		if !quoted && !strings.Contains(word, `"`) && !strings.HasPrefix(word, "-") && len(word) > 1 && strings.HasSuffix(word, "*") {
+			prefixes = append(prefixes, tsqueryPrefix(strings.TrimSuffix(word, "*")))
+			continue
+		}
+
+		if strings.Count(word, `"`)%2 == 1 {
+			quoted = !quoted
+		}
+		words = append(words, word)
+	}
+
+	var queries []string
+
+	if len(words) > 0 {
+		queries = append(queries, fmt.Sprintf("websearch_to_tsquery('%s', %s)", language, w.Param(strings.Join(words, " "))))
+	}
+	if len(prefixes) > 0 {
+		queries = append(queries, fmt.Sprintf("to_tsquery('%s', %s)", language, w.Param(strings.Join(prefixes, " & "))))
+	}
+
+	s := titleSearch{
+		language: language,
+		query:    "(" + strings.Join(queries, " && ") + ")",
+	}
+
+	if fuzzy {
+		s.fuzzy = w.Param(search)
+	}
+
+	return s
+}
+
+// tsqueryPrefix quotes word as a tsquery lexeme which matches anything starting with
+// it. The word is still normalised by the text search configuration.
+func tsqueryPrefix(word string) string {
+	word = strings.ReplaceAll(word, `\`, `\\`)
+	word = strings.ReplaceAll(word, `'`, `''`)
+	return "'" + word + "':*"
+}
+
+func (s titleSearch) vector() string {
+	return fmt.Sprintf("to_tsvector('%s', title)", s.language)
+}
+
+// match uses <% for fuzzy matches, which is true when the search is similar enough to
+// some part of the title and can use movies_title_trgm_idx.
+func (s titleSearch) match() string {
+	if s.fuzzy != "" {
+		return fmt.Sprintf("%s @@ %s OR %s <%% title", s.vector(), s.query, s.fuzzy)
+	}
+	return fmt.Sprintf("%s @@ %s", s.vector(), s.query)
+}
+
+// rank adds the similarity for fuzzy searches, so that exact matches, which have a
+// similarity of 1, still come first.
+func (s titleSearch) rank() string {
+	if s.fuzzy != "" {
+		return fmt.Sprintf("ts_rank(%s, %s) + word_similarity(%s, title)", s.vector(), s.query, s.fuzzy)
+	}
+	return fmt.Sprintf("ts_rank(%s, %s)", s.vector(), s.query)
+}
+
+// the markers ts_headline puts around matches. They are private use characters rather
+// than markup, since titles aren't escaped and clients may not expect to escape them.
+const (
+	highlightStart = '\uE000'
+	highlightStop  = '\uE001'
+)
+
+// headline marks the words in the title that matched the search, for highlights to
+// find.
+func (s titleSearch) headline() string {
+	return fmt.Sprintf("ts_headline('%s', title, %s, 'HighlightAll=true, StartSel=%c, StopSel=%c')", s.language, s.query, highlightStart, highlightStop)
+}
+
+// Highlight is the part of a title that matched a search, as offsets in characters
+// from its start, with End exclusive.
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// highlights finds the matches marked in a headline
+func highlights(headline string) []Highlight {
+	var (
+		spans []Highlight
+		i     int
+	)
+
+	for _, r := range headline {
+		switch r {
+		case highlightStart:
+			spans = append(spans, Highlight{Start: i})
+		case highlightStop:
+			if len(spans) > 0 {
+				spans[len(spans)-1].End = i
+			}
+		default:
+			i++
+		}
+	}
+
+	return spans
+}
+
+// TitleSuggestion is a title suggested to complete a search, with how similar it is
+// to the search from 0 to 1.
+type TitleSuggestion struct {
+	ID    int64   `json:"id"`
+	Title string  `json:"title"`
+	Score float32 `json:"score"`
+}
+
+// Autocomplete suggests up to limit titles for a partly typed search. It is called on
+// every keystroke, so it only looks at the trigram index and gives up after a second.
+func (m MovieModel) Autocomplete(search string, limit int) ([]*TitleSuggestion, error) {
+	query := `
+		SELECT id, title, word_similarity($1, title) AS score
+		FROM movies
+		WHERE $1 <% title AND deleted_at IS NULL
+		ORDER BY score DESC, length(title), title
+		LIMIT $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, search, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	suggestions := []*TitleSuggestion{}
+
+	for rows.Next() {
+		var suggestion TitleSuggestion
+
+		err := rows.Scan(&suggestion.ID, &suggestion.Title, &suggestion.Score)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &suggestion)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return suggestions, nil
+}
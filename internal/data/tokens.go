@@ -5,14 +5,24 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
+	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"greenlight.temideewan.net/internal/validator"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeTwoFactor      = "2fa-pending"
+	ScopeEmailChange    = "email-change"
+)
+
+var (
+	ErrRefreshTokenReused = errors.New("refresh token reused")
 )
 
 type Token struct {
@@ -21,6 +31,35 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	IPAddress string    `json:"-"`
+	UserAgent string    `json:"-"`
+	Family    string    `json:"-"`
+	// the permissions the token is limited to, or nil if it may use all of its
+	// user's permissions
+	Permissions Permissions `json:"permissions,omitzero"`
+}
+
+// Session describes a token family, started by a single login, without exposing any
+// of the tokens in it.
+type Session struct {
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	IPAddress  string     `json:"ip_address"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
+}
+
+// TokenMetadata is everything stored about a token apart from its hash.
+type TokenMetadata struct {
+	Scope       string      `json:"scope"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	UsedAt      *time.Time  `json:"used_at"`
+	Expiry      time.Time   `json:"expiry"`
+	IPAddress   string      `json:"ip_address"`
+	UserAgent   string      `json:"user_agent"`
+	Permissions Permissions `json:"permissions,omitzero"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) *Token {
@@ -31,12 +70,16 @@ func generateToken(userID int64, ttl time.Duration, scope string) *Token {
 		Scope:     scope,
 	}
 
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	token.Hash = hashToken(token.Plaintext)
 
 	return token
 }
 
+func hashToken(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
 // helper function to validate the token
 
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlainText string) {
@@ -55,12 +98,126 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// generate a token which records the client it was issued to, so that it can be
+// listed as part of a session, and the permissions it is limited to (nil for none).
+func generateSessionToken(userID int64, ttl time.Duration, scope, family string, permissions Permissions, ipAddress, userAgent string) *Token {
+	token := generateToken(userID, ttl, scope)
+	token.Family = family
+	token.Permissions = permissions
+	token.IPAddress = ipAddress
+	token.UserAgent = userAgent
+	return token
+}
+
+// NewRefresh starts a new token family with a long-lived refresh token, which can be
+// exchanged for a new one using Rotate. Every token in the family is limited to
+// permissions, unless it is nil.
+func (m TokenModel) NewRefresh(userID int64, ttl time.Duration, permissions Permissions, ipAddress, userAgent string) (*Token, error) {
+	token := generateSessionToken(userID, ttl, ScopeRefresh, rand.Text(), permissions, ipAddress, userAgent)
+	err := m.Insert(token)
+	return token, err
+}
+
+// NewAccess creates a short-lived authentication token belonging to the given family.
+// An empty family starts a new one, for tokens issued without a refresh token, so
+// that they still show up as a session of their own.
+func (m TokenModel) NewAccess(userID int64, ttl time.Duration, family string, permissions Permissions, ipAddress, userAgent string) (*Token, error) {
+	if family == "" {
+		family = rand.Text()
+	}
+
+	token := generateSessionToken(userID, ttl, ScopeAuthentication, family, permissions, ipAddress, userAgent)
+	err := m.Insert(token)
+	return token, err
+}
+
+// Rotate exchanges an unused refresh token for a new one in the same family, and marks
+// the old refresh token as used. If the refresh token has already been used then it
+// has most likely been stolen, so the whole family is revoked and
+// ErrRefreshTokenReused is returned.
+func (m TokenModel) Rotate(plainTextToken string, ttl time.Duration, ipAddress, userAgent string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	SELECT user_id, family, permissions, expiry, used_at IS NOT NULL
+	FROM tokens
+	WHERE scope = $1 AND hash = $2
+	FOR UPDATE
+	`
+
+	var (
+		userID      int64
+		family      string
+		permissions Permissions
+		expiry      time.Time
+		used        bool
+	)
+
+	err = tx.QueryRowContext(ctx, query, ScopeRefresh, hashToken(plainTextToken)).Scan(&userID, &family, pq.Array(&permissions), &expiry, &used)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if used {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	if !expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, hashToken(plainTextToken))
+	if err != nil {
+		return nil, err
+	}
+
+	token := generateSessionToken(userID, ttl, ScopeRefresh, family, permissions, ipAddress, userAgent)
+
+	query = `
+		INSERT INTO tokens(hash, user_id, expiry, scope, ip_address, user_agent, family, permissions)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.IPAddress, token.UserAgent, token.Family, pq.Array(token.Permissions)}
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-		INSERT INTO tokens(hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO tokens(hash, user_id, expiry, scope, ip_address, user_agent, family, permissions)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	`
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.IPAddress, token.UserAgent, token.Family, pq.Array(token.Permissions)}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -80,3 +237,195 @@ func (m TokenModel) DeleteAllForUsers(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// return when the most recent token of a scope was issued to a user, or the zero time
+// if they don't have one.
+func (m TokenModel) LastCreatedForUser(scope string, userID int64) (time.Time, error) {
+	query := `
+	SELECT COALESCE(max(created_at), 'epoch') FROM tokens WHERE scope = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var createdAt time.Time
+
+	err := m.DB.QueryRowContext(ctx, query, scope, userID).Scan(&createdAt)
+	return createdAt, err
+}
+
+// delete all the access and refresh tokens that make up a user's sessions
+func (m TokenModel) DeleteAllSessionsForUser(userID int64) error {
+	query := `
+	DELETE FROM tokens WHERE scope IN ($1, $2) AND user_id = $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ScopeAuthentication, ScopeRefresh, userID)
+	return err
+}
+
+// delete a single token using its plaintext value, along with every other token in
+// its family so that a refresh token can't be used to bring the session back.
+func (m TokenModel) Delete(scope, plainTextToken string) error {
+	query := `
+	DELETE FROM tokens
+	WHERE (scope = $1 AND hash = $2)
+	OR family IN (SELECT family FROM tokens WHERE scope = $1 AND hash = $2 AND family <> '')
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, scope, hashToken(plainTextToken))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// delete every token in a family, ending the session it represents
+func (m TokenModel) DeleteFamily(family string) error {
+	query := `
+	DELETE FROM tokens WHERE family = $1 AND family <> ''
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return err
+}
+
+// record that a token has just been used. To avoid a write on every single request
+// the timestamp is only moved forward once it is more than a minute old.
+func (m TokenModel) UpdateLastUsed(plainTextToken string) error {
+	query := `
+	UPDATE tokens
+	SET last_used_at = NOW()
+	WHERE hash = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hashToken(plainTextToken))
+	return err
+}
+
+// list a user's sessions. Each token family that still has a live refresh token is a
+// session, as is each family made up of a live access token issued without one. The
+// one containing current (matched on its plaintext for database-backed tokens, or its
+// family for signed ones) is marked as current.
+func (m TokenModel) GetAllSessionsForUser(userID int64, current *Token) ([]*Session, error) {
+	query := `
+	SELECT
+		min(created_at),
+		max(GREATEST(last_used_at, used_at)),
+		COALESCE(max(expiry) FILTER (WHERE scope = $2), max(expiry)),
+		(array_agg(ip_address ORDER BY created_at DESC))[1],
+		(array_agg(user_agent ORDER BY created_at DESC))[1],
+		bool_or(hash = $3 OR family = $4)
+	FROM tokens
+	WHERE user_id = $1 AND family <> ''
+	GROUP BY family
+	HAVING bool_or(scope = $2 AND used_at IS NULL AND expiry > NOW())
+		OR (NOT bool_or(scope = $2) AND bool_or(expiry > NOW()))
+	ORDER BY min(created_at) DESC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{userID, ScopeRefresh, hashToken(current.Plaintext), current.Family}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IPAddress,
+			&session.UserAgent,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// list the metadata of every token the user holds, whatever its scope
+func (m TokenModel) GetAllMetadataForUser(userID int64) ([]*TokenMetadata, error) {
+	query := `
+	SELECT scope, created_at, last_used_at, used_at, expiry, ip_address, user_agent, permissions
+	FROM tokens
+	WHERE user_id = $1
+	ORDER BY created_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*TokenMetadata{}
+
+	for rows.Next() {
+		var token TokenMetadata
+
+		err := rows.Scan(
+			&token.Scope,
+			&token.CreatedAt,
+			&token.LastUsedAt,
+			&token.UsedAt,
+			&token.Expiry,
+			&token.IPAddress,
+			&token.UserAgent,
+			pq.Array(&token.Permissions),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
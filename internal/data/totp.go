@@ -0,0 +1,244 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"greenlight.temideewan.net/internal/totp"
+	"greenlight.temideewan.net/internal/validator"
+)
+
+var (
+	TOTPCodeRX = regexp.MustCompile(`^[0-9]{6}$`)
+)
+
+type TOTPCredential struct {
+	UserID    int64
+	Secret    string
+	Confirmed bool
+	CreatedAt time.Time
+	// the time step of the last code that was accepted, so that it can't be used again
+	LastUsedStep int64
+}
+
+// a second factor is either a 6 digit code from the user's authenticator app, or one
+// of their recovery codes.
+func ValidateSecondFactor(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(validator.Matches(code, TOTPCodeRX) || len(normalizeRecoveryCode(code)) == 10, "code", "must be a 6 digit code or a recovery code")
+}
+
+// recovery codes are shown as XXXXX-XXXXX, but we accept them in any case and with or
+// without the dash.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+func (m TOTPModel) Get(userID int64) (*TOTPCredential, error) {
+	query := `
+	SELECT user_id, secret, confirmed, created_at, last_used_step
+	FROM totp_credentials
+	WHERE user_id = $1
+	`
+
+	var credential TOTPCredential
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&credential.UserID,
+		&credential.Secret,
+		&credential.Confirmed,
+		&credential.CreatedAt,
+		&credential.LastUsedStep,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &credential, nil
+}
+
+// New generates a fresh secret for the user, replacing any enrollment they started but
+// never confirmed. A confirmed credential is never replaced; ErrEditConflict is
+// returned instead.
+func (m TOTPModel) New(userID int64) (*TOTPCredential, error) {
+	query := `
+	INSERT INTO totp_credentials (user_id, secret)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+	WHERE totp_credentials.confirmed = false
+	RETURNING created_at
+	`
+
+	credential := &TOTPCredential{
+		UserID: userID,
+		Secret: totp.GenerateSecret(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, credential.UserID, credential.Secret).Scan(&credential.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrEditConflict
+		default:
+			return nil, err
+		}
+	}
+	return credential, nil
+}
+
+// UseCode reports whether code is the current one-time password for the credential,
+// and if so records it as used. Codes from the same time step as one that was already
+// used, or an earlier one, are rejected.
+func (m TOTPModel) UseCode(credential *TOTPCredential, code string) (bool, error) {
+	step, ok := totp.Validate(credential.Secret, code, time.Now())
+	if !ok || step <= credential.LastUsedStep {
+		return false, nil
+	}
+
+	// the condition on last_used_step stops two requests with the same code both
+	// getting through
+	query := `
+	UPDATE totp_credentials
+	SET last_used_step = $2
+	WHERE user_id = $1 AND last_used_step < $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, credential.UserID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if rowsAffected == 0 {
+		return false, nil
+	}
+
+	credential.LastUsedStep = step
+	return true, nil
+}
+
+func (m TOTPModel) Confirm(userID int64) error {
+	query := `
+	UPDATE totp_credentials
+	SET confirmed = true
+	WHERE user_id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Delete turns two-factor authentication off for the user, along with their recovery
+// codes.
+func (m TOTPModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_credentials WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// NewRecoveryCodes replaces the user's recovery codes with n new ones, returning them
+// in plaintext. Only their hashes are stored.
+func (m TOTPModel) NewRecoveryCodes(userID int64, n int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, n)
+
+	for i := range codes {
+		code := rand.Text()[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hashToken(code))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode consumes one of the user's recovery codes, reporting whether it was
+// valid.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+	DELETE FROM recovery_codes
+	WHERE user_id = $1 AND hash = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
@@ -2,12 +2,13 @@ package data
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/lib/pq"
 	"greenlight.temideewan.net/internal/validator"
 )
 
@@ -24,6 +25,7 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
+	Suspended bool      `json:"suspended"`
 	Version   int       `json:"-"`
 }
 
@@ -36,9 +38,9 @@ type password struct {
 	hash      []byte
 }
 
-// set password using bcrypt for hashing
+// set password using the configured password hasher
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), bcrypt.DefaultCost)
+	hash, err := passwordHasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -52,17 +54,13 @@ func (p *password) Set(plaintextPassword string) error {
 // hashed password stored in the struct, returning true if it matches and false
 // otherwise.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-	return true, nil
+	return compareHashAndPassword(p.hash, plaintextPassword)
+}
 
+// NeedsRehash reports whether the stored hash was made with an older algorithm or
+// weaker parameters than the configured password hasher uses.
+func (p *password) NeedsRehash() bool {
+	return passwordHasher.NeedsRehash(p.hash)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -73,7 +71,7 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePassword(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= passwordHasher.MaxLength(), "password", fmt.Sprintf("must not be more than %d bytes long", passwordHasher.MaxLength()))
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -95,7 +93,10 @@ type UserModel struct {
 	DB *sql.DB
 }
 
-func (m UserModel) Insert(user *User) error {
+// insert a new user, along with the role they start with unless it is empty. If there
+// is no role with that name the user isn't inserted either, and ErrRecordNotFound is
+// returned.
+func (m UserModel) Insert(user *User, role string) error {
 	query := `
 	INSERT INTO users(name, email, password_hash, activated)
 	VALUES ($1,$2,$3,$4)
@@ -106,7 +107,13 @@ func (m UserModel) Insert(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -115,12 +122,72 @@ func (m UserModel) Insert(user *User) error {
 			return err
 		}
 	}
-	return nil
+
+	if role != "" {
+		query = `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = $2
+		`
+
+		result, err := tx.ExecContext(ctx, query, user.ID, role)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, name, email, password_hash, activated, suspended, version
+	FROM users
+	WHERE id = $1
+	`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Suspended,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
 }
 
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-	SELECT id, created_at, name, email, password_hash, activated, version
+	SELECT id, created_at, name, email, password_hash, activated, suspended, version
 	FROM users
 	WHERE email = $1
 	`
@@ -137,6 +204,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Suspended,
 		&user.Version,
 	)
 
@@ -151,11 +219,76 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// list users whose name or email contains search, optionally only those with the
+// given activation state.
+func (m UserModel) GetAll(search string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) over(), id, created_at, name, email, activated, suspended, version
+		FROM users
+		WHERE (name ILIKE '%%' || $1 || '%%' ESCAPE '\' OR email ILIKE '%%' || $1 || '%%' ESCAPE '\' OR $1 = '')
+		AND (activated = $2 OR $2 IS NULL)
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4
+	`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	args := []any{escapeLike(search), activated, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Suspended,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metaData := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+	return users, metaData, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike escapes the characters that are special in a LIKE pattern, so that s only
+// matches itself. The pattern must use ESCAPE '\'.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// Update saves the user. Activating a user also cancels their account's scheduled
+// deletion.
 func (m UserModel) Update(user *User) error {
 	query := `
 	UPDATE users
-	SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-	WHERE id = $5 AND version = $6
+	SET name = $1, email = $2, password_hash = $3, activated = $4, suspended = $5,
+		deletion_scheduled_at = CASE WHEN $4 THEN NULL ELSE deletion_scheduled_at END,
+		version = version + 1
+	WHERE id = $6 AND version = $7
 	RETURNING version
 	`
 
@@ -164,6 +297,7 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Suspended,
 		user.ID,
 		user.Version,
 	}
@@ -186,14 +320,136 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
+// store an email address the user wants to change to. It only replaces their current
+// address once ConfirmPendingEmail is called.
+func (m UserModel) SetPendingEmail(userID int64, email string) error {
+	query := `
+	UPDATE users
+	SET pending_email = $1
+	WHERE id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email, userID)
+	return err
+}
+
+// swap the user's email address for their pending one, returning the updated user
+func (m UserModel) ConfirmPendingEmail(userID int64) (*User, error) {
+	query := `
+	UPDATE users
+	SET email = pending_email, pending_email = NULL, version = version + 1
+	WHERE id = $1 AND pending_email IS NOT NULL
+	RETURNING id, created_at, name, email, password_hash, activated, suspended, version
+	`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Suspended,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return nil, ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// deactivate the user's account and mark it to be permanently deleted at the given
+// time. Until then it can be restored by activating it again.
+func (m UserModel) ScheduleDeletion(user *User, at time.Time) error {
+	query := `
+	UPDATE users
+	SET activated = false, deletion_scheduled_at = $1, version = version + 1
+	WHERE id = $2 AND version = $3
+	RETURNING activated, version
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, at, user.ID, user.Version).Scan(&user.Activated, &user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// permanently delete the accounts whose deletion grace period is over and that
+// haven't been activated again since. Their tokens, permissions and everything else
+// tied to the user are removed by ON DELETE CASCADE.
+func (m UserModel) DeleteScheduled() (int64, error) {
+	query := `
+	DELETE FROM users
+	WHERE deletion_scheduled_at <= NOW() AND activated = false
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Rehash upgrades the stored hash of a user's password to the configured password
+// hasher. It only replaces the hash it was given, so it never overwrites a password
+// that has been changed in the meantime.
+func (m UserModel) Rehash(user *User, plaintextPassword string) error {
+	oldHash := user.Password.hash
+
+	err := user.Password.Set(plaintextPassword)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE users
+	SET password_hash = $1
+	WHERE id = $2 AND password_hash = $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, user.Password.hash, user.ID, oldHash)
+	return err
+}
+
 func (m UserModel) GetForToken(scope, plainTextToken string) (*User, error) {
-	hash := sha256.Sum256([]byte(plainTextToken))
+	hash := hashToken(plainTextToken)
 	query := `
-	SELECT u.id, u.name, u.email, u.created_at, u.activated, u.version, u.password_hash FROM users u INNER JOIN
+	SELECT u.id, u.name, u.email, u.created_at, u.activated, u.suspended, u.version, u.password_hash FROM users u INNER JOIN
 	tokens t ON u.id = t.user_id
 	WHERE t.scope = $1 AND t.hash = $2 AND t.expiry > $3
 	`
-	args := []any{scope, hash[:], time.Now()}
+	args := []any{scope, hash, time.Now()}
 	var user User
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -205,6 +461,7 @@ func (m UserModel) GetForToken(scope, plainTextToken string) (*User, error) {
 		&user.Email,
 		&user.CreatedAt,
 		&user.Activated,
+		&user.Suspended,
 		&user.Version,
 		&user.Password.hash,
 	)
@@ -219,3 +476,49 @@ func (m UserModel) GetForToken(scope, plainTextToken string) (*User, error) {
 	}
 	return &user, nil
 }
+
+// GetForAuthenticationToken is GetForToken for authentication tokens, which also
+// returns the token so that its family and permissions are known.
+func (m UserModel) GetForAuthenticationToken(plainTextToken string) (*User, *Token, error) {
+	query := `
+	SELECT u.id, u.name, u.email, u.created_at, u.activated, u.suspended, u.version, u.password_hash,
+		t.expiry, t.family, t.permissions
+	FROM users u INNER JOIN
+	tokens t ON u.id = t.user_id
+	WHERE t.scope = $1 AND t.hash = $2 AND t.expiry > $3
+	`
+	args := []any{ScopeAuthentication, hashToken(plainTextToken), time.Now()}
+
+	var user User
+
+	token := Token{Plaintext: plainTextToken, Scope: ScopeAuthentication}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.Name,
+		&user.Email,
+		&user.CreatedAt,
+		&user.Activated,
+		&user.Suspended,
+		&user.Version,
+		&user.Password.hash,
+		&token.Expiry,
+		&token.Family,
+		pq.Array(&token.Permissions),
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	token.UserID = user.ID
+	return &user, &token, nil
+}
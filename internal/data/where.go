@@ -0,0 +1,52 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Where builds a parameterised WHERE clause out of conditions which are only added
+// when they're needed, numbering the placeholders as it goes.
+type Where struct {
+	conditions []string
+	args       []any
+}
+
+// Add appends a condition, replacing each ? in it with a placeholder for the
+// corresponding argument.
+func (w *Where) Add(condition string, args ...any) {
+	parts := strings.Split(condition, "?")
+	if len(parts)-1 != len(args) {
+		panic(fmt.Sprintf("condition %q has %d placeholders but %d arguments", condition, len(parts)-1, len(args)))
+	}
+
+	var b strings.Builder
+
+	b.WriteString(parts[0])
+	for i, arg := range args {
+		b.WriteString(w.Param(arg))
+		b.WriteString(parts[i+1])
+	}
+
+	w.conditions = append(w.conditions, b.String())
+}
+
+// Param adds an argument without a condition, for use elsewhere in the query, and
+// returns its placeholder.
+func (w *Where) Param(arg any) string {
+	w.args = append(w.args, arg)
+	return fmt.Sprintf("$%d", len(w.args))
+}
+
+// String returns the conditions joined with AND, or TRUE if there aren't any.
+func (w *Where) String() string {
+	if len(w.conditions) == 0 {
+		return "TRUE"
+	}
+	return "(" + strings.Join(w.conditions, ") AND (") + ")"
+}
+
+// Args returns the arguments for the placeholders, in order.
+func (w *Where) Args() []any {
+	return w.args
+}
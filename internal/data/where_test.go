@@ -0,0 +1,143 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.temideewan.net/internal/validator"
+)
+
+func TestWhere(t *testing.T) {
+	var w Where
+
+	if got := w.String(); got != "TRUE" {
+		t.Errorf("empty: got %q, want TRUE", got)
+	}
+
+	w.Add("deleted_at IS NULL")
+	w.Add("year >= ?", 1990)
+	w.Add("runtime BETWEEN ? AND ?", 90, 120)
+
+	limit := w.Param(20)
+
+	wantSQL := "(deleted_at IS NULL) AND (year >= $1) AND (runtime BETWEEN $2 AND $3)"
+	if got := w.String(); got != wantSQL {
+		t.Errorf("got %q, want %q", got, wantSQL)
+	}
+
+	if limit != "$4" {
+		t.Errorf("got param %q, want $4", limit)
+	}
+
+	wantArgs := []any{1990, 90, 120, 20}
+	if !reflect.DeepEqual(w.Args(), wantArgs) {
+		t.Errorf("got args %v, want %v", w.Args(), wantArgs)
+	}
+}
+
+func TestWherePlaceholderMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Add with too few arguments didn't panic")
+		}
+	}()
+
+	var w Where
+	w.Add("year >= ? AND year <= ?", 1990)
+}
+
+func TestMovieFiltersWhere(t *testing.T) {
+	after := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		filters  MovieFilters
+		wantSQL  string
+		wantArgs []any
+	}{
+		{
+			name:    "no filters",
+			wantSQL: "(deleted_at IS NULL)",
+		},
+		{
+			name:     "genres",
+			filters:  MovieFilters{Genres: []string{"drama"}, AnyGenres: []string{"comedy", "action"}, ExcludeGenres: []string{"horror"}},
+			wantSQL:  "(deleted_at IS NULL) AND (genres @> $1) AND (genres && $2) AND (NOT genres && $3)",
+			wantArgs: []any{pq.Array([]string{"drama"}), pq.Array([]string{"comedy", "action"}), pq.Array([]string{"horror"})},
+		},
+		{
+			name:     "ranges",
+			filters:  MovieFilters{YearMin: 1990, YearMax: 1999, RuntimeMin: 90, CreatedAfter: after},
+			wantSQL:  "(deleted_at IS NULL) AND (year >= $1) AND (year <= $2) AND (runtime >= $3) AND (created_at > $4)",
+			wantArgs: []any{int32(1990), int32(1999), Runtime(90), after},
+		},
+		{
+			name:     "title",
+			filters:  MovieFilters{Title: "star wars", Language: "english"},
+			wantSQL:  "(deleted_at IS NULL) AND (to_tsvector('english', title) @@ (websearch_to_tsquery('english', $1)))",
+			wantArgs: []any{"star wars"},
+		},
+		{
+			name:     "title prefix",
+			filters:  MovieFilters{Title: "star wa*"},
+			wantSQL:  "(deleted_at IS NULL) AND (to_tsvector('simple', title) @@ (websearch_to_tsquery('simple', $1) && to_tsquery('simple', $2)))",
+			wantArgs: []any{"star", "'wa':*"},
+		},
+		{
+			name:    "title of spaces",
+			filters: MovieFilters{Title: "   "},
+			wantSQL: "(deleted_at IS NULL)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w Where
+
+			tt.filters.where(&w)
+
+			if got := w.String(); got != tt.wantSQL {
+				t.Errorf("got %q, want %q", got, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(w.Args(), tt.wantArgs) {
+				t.Errorf("got args %v, want %v", w.Args(), tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestValidateMovieFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters MovieFilters
+		wantKey string
+	}{
+		{"valid", MovieFilters{YearMin: 1990, YearMax: 1999, Language: "english"}, ""},
+		{"negative year", MovieFilters{YearMin: -1}, "year_min"},
+		{"years reversed", MovieFilters{YearMin: 2000, YearMax: 1990}, "year_min"},
+		{"runtimes reversed", MovieFilters{RuntimeMin: 120, RuntimeMax: 90}, "runtime_min"},
+		{"dates reversed", MovieFilters{CreatedAfter: time.Unix(100, 0), CreatedBefore: time.Unix(50, 0)}, "created_after"},
+		{"too many genres", MovieFilters{AnyGenres: make([]string, 21)}, "genres_any"},
+		{"unknown language", MovieFilters{Language: "klingon"}, "language"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+
+			ValidateMovieFilters(v, tt.filters)
+
+			if tt.wantKey == "" {
+				if !v.Valid() {
+					t.Errorf("got errors %v, want none", v.Errors)
+				}
+				return
+			}
+			if _, ok := v.Errors[tt.wantKey]; !ok {
+				t.Errorf("got errors %v, want one for %s", v.Errors, tt.wantKey)
+			}
+		})
+	}
+}
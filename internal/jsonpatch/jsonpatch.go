@@ -0,0 +1,424 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+// documents to JSON values.
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidPatch = errors.New("invalid patch")
+	ErrTestFailed   = errors.New("test operation failed")
+)
+
+// Merge applies an RFC 7396 merge patch to doc. Members of the patch which are null
+// are removed from the document, objects are merged recursively and anything else
+// replaces the value in the document.
+func Merge(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+	}
+
+	return json.Marshal(merge(target, p))
+}
+
+func merge(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = merge(t[key], value)
+		}
+	}
+	return t
+}
+
+// Operation is a single step of an RFC 6902 patch
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Apply applies an RFC 6902 patch to doc. The operations are applied in order, and if
+// any of them fails the whole patch does. A failed test operation returns an error
+// wrapping ErrTestFailed, and anything else wrong with the patch one wrapping
+// ErrInvalidPatch.
+func Apply(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var operations []Operation
+
+	err = json.Unmarshal(patch, &operations)
+	if err != nil {
+		return nil, fmt.Errorf("%w: must be an array of operations", ErrInvalidPatch)
+	}
+
+	for i, operation := range operations {
+		target, err = apply(target, operation)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+
+	return json.Marshal(target)
+}
+
+func apply(doc any, operation Operation) (any, error) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return nil, fmt.Errorf("%w: %s operation is missing a value", ErrInvalidPatch, operation.Op)
+		}
+
+		value, err := decode(operation.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+		}
+
+		switch operation.Op {
+		case "add":
+			return add(doc, path, value)
+		case "replace":
+			return replace(doc, path, value)
+		default:
+			current, err := get(doc, path)
+			if err != nil {
+				return nil, err
+			}
+			if !equal(current, value) {
+				return nil, fmt.Errorf("%w: %q does not have the expected value", ErrTestFailed, operation.Path)
+			}
+			return doc, nil
+		}
+
+	case "remove":
+		return remove(doc, path)
+
+	case "move", "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+
+		if operation.Op == "move" {
+			if len(path) > len(from) && isPrefix(from, path) {
+				return nil, fmt.Errorf("%w: cannot move %q into one of its children", ErrInvalidPatch, operation.From)
+			}
+
+			doc, err = remove(doc, from)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// copy the value, so later operations on one don't change the other
+			value, err = clone(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return add(doc, path, value)
+
+	default:
+		return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalidPatch, operation.Op)
+	}
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: path %q must start with /", ErrInvalidPatch, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func get(doc any, path []string) (any, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, notFound(path)
+			}
+			doc = value
+		case []any:
+			i, err := index(token, len(node)-1)
+			if err != nil {
+				return nil, notFound(path)
+			}
+			doc = node[i]
+		default:
+			return nil, notFound(path)
+		}
+	}
+	return doc, nil
+}
+
+// update replaces the container holding the last token of path with the result of
+// calling fn on it, and returns the new document. This is needed because adding to
+// or removing from an array makes a new slice, which has to be stored in its parent.
+func update(doc any, path []string, fn func(container any, token string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, notFound(path)
+		}
+
+		child, err := update(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+
+		node[path[0]] = child
+		return node, nil
+
+	case []any:
+		i, err := index(path[0], len(node)-1)
+		if err != nil {
+			return nil, notFound(path)
+		}
+
+		child, err := update(node[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+
+		node[i] = child
+		return node, nil
+
+	default:
+		return nil, notFound(path)
+	}
+}
+
+func add(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(doc, path, func(container any, token string) (any, error) {
+		switch node := container.(type) {
+		case map[string]any:
+			node[token] = value
+			return node, nil
+
+		case []any:
+			if token == "-" {
+				return append(node, value), nil
+			}
+
+			i, err := index(token, len(node))
+			if err != nil {
+				return nil, notFound(path)
+			}
+
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+
+		default:
+			return nil, notFound(path)
+		}
+	})
+}
+
+func remove(doc any, path []string) (any, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: cannot remove the whole document", ErrInvalidPatch)
+	}
+
+	return update(doc, path, func(container any, token string) (any, error) {
+		switch node := container.(type) {
+		case map[string]any:
+			if _, ok := node[token]; !ok {
+				return nil, notFound(path)
+			}
+
+			delete(node, token)
+			return node, nil
+
+		case []any:
+			i, err := index(token, len(node)-1)
+			if err != nil {
+				return nil, notFound(path)
+			}
+
+			return append(node[:i], node[i+1:]...), nil
+
+		default:
+			return nil, notFound(path)
+		}
+	})
+}
+
+func replace(doc any, path []string, value any) (any, error) {
+	if _, err := get(doc, path); err != nil {
+		return nil, err
+	}
+
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(doc, path, func(container any, token string) (any, error) {
+		switch node := container.(type) {
+		case map[string]any:
+			node[token] = value
+			return node, nil
+		case []any:
+			i, _ := index(token, len(node)-1)
+			node[i] = value
+			return node, nil
+		default:
+			return nil, notFound(path)
+		}
+	})
+}
+
+// index parses an array index token, which must be between 0 and max
+func index(token string, max int) (int, error) {
+	// leading zeros aren't allowed, so "01" doesn't mean the same as "1"
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, ErrInvalidPatch
+	}
+
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max {
+		return 0, ErrInvalidPatch
+	}
+	return i, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func notFound(path []string) error {
+	return fmt.Errorf("%w: path /%s does not exist", ErrInvalidPatch, strings.Join(path, "/"))
+}
+
+// decode parses a JSON value, keeping numbers as json.Number so that they survive a
+// round trip unchanged.
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var value any
+
+	err := dec.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	if dec.More() {
+		return nil, errors.New("must only contain a single JSON value")
+	}
+	return value, nil
+}
+
+func clone(value any) (any, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// equal compares two decoded JSON values as RFC 6902 requires for the test operation,
+// so numbers are equal if they have the same value however they are written.
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,257 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func assertJSONEqual(t *testing.T, got []byte, want string) {
+	t.Helper()
+
+	var g, w any
+
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid result %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("invalid expected value %s: %v", want, err)
+	}
+
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// the examples from RFC 7396 Appendix A
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		doc   string
+		patch string
+		want  string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.patch, func(t *testing.T) {
+			got, err := Merge([]byte(tt.doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSONEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestMergeInvalidPatch(t *testing.T) {
+	_, err := Merge([]byte(`{}`), []byte(`{"a":`))
+	if !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidPatch)
+	}
+}
+
+// the examples from RFC 6902 Appendix A, followed by a few more error cases
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		patch   string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "A.1 adding an object member",
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/baz","value":"qux"}]`,
+			want:  `{"baz":"qux","foo":"bar"}`,
+		},
+		{
+			name:  "A.2 adding an array element",
+			doc:   `{"foo":["bar","baz"]}`,
+			patch: `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			want:  `{"foo":["bar","qux","baz"]}`,
+		},
+		{
+			name:  "A.3 removing an object member",
+			doc:   `{"baz":"qux","foo":"bar"}`,
+			patch: `[{"op":"remove","path":"/baz"}]`,
+			want:  `{"foo":"bar"}`,
+		},
+		{
+			name:  "A.4 removing an array element",
+			doc:   `{"foo":["bar","qux","baz"]}`,
+			patch: `[{"op":"remove","path":"/foo/1"}]`,
+			want:  `{"foo":["bar","baz"]}`,
+		},
+		{
+			name:  "A.5 replacing a value",
+			doc:   `{"baz":"qux","foo":"bar"}`,
+			patch: `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			want:  `{"baz":"boo","foo":"bar"}`,
+		},
+		{
+			name:  "A.6 moving a value",
+			doc:   `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			patch: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			want:  `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{
+			name:  "A.7 moving an array element",
+			doc:   `{"foo":["all","grass","cows","eat"]}`,
+			patch: `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			want:  `{"foo":["all","cows","eat","grass"]}`,
+		},
+		{
+			name:  "A.8 testing a value: success",
+			doc:   `{"baz":"qux","foo":["a",2,"c"]}`,
+			patch: `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			want:  `{"baz":"qux","foo":["a",2,"c"]}`,
+		},
+		{
+			name:    "A.9 testing a value: error",
+			doc:     `{"baz":"qux"}`,
+			patch:   `[{"op":"test","path":"/baz","value":"bar"}]`,
+			wantErr: ErrTestFailed,
+		},
+		{
+			name:  "A.10 adding a nested member object",
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+			want:  `{"foo":"bar","child":{"grandchild":{}}}`,
+		},
+		{
+			name:  "A.11 ignoring unrecognized elements",
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/baz","value":"qux","xyz":123}]`,
+			want:  `{"foo":"bar","baz":"qux"}`,
+		},
+		{
+			name:    "A.12 adding to a nonexistent target",
+			doc:     `{"foo":"bar"}`,
+			patch:   `[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "A.13 invalid JSON patch document",
+			doc:     `{"foo":"bar"}`,
+			patch:   `[{"op":"add","path":"/baz","value":"qux","op":"remove"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:  "A.14 ~ escape ordering",
+			doc:   `{"/":9,"~1":10}`,
+			patch: `[{"op":"test","path":"/~01","value":10}]`,
+			want:  `{"/":9,"~1":10}`,
+		},
+		{
+			name:    "A.15 comparing strings and numbers",
+			doc:     `{"/":9,"~1":10}`,
+			patch:   `[{"op":"test","path":"/~01","value":"10"}]`,
+			wantErr: ErrTestFailed,
+		},
+		{
+			name:  "A.16 adding an array value",
+			doc:   `{"foo":["bar"]}`,
+			patch: `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+			want:  `{"foo":["bar",["abc","def"]]}`,
+		},
+		{
+			name:  "copying a value",
+			doc:   `{"foo":{"bar":1}}`,
+			patch: `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`,
+			want:  `{"foo":{"bar":1},"baz":{"bar":2}}`,
+		},
+		{
+			name:  "numbers compared by value",
+			doc:   `{"n":1}`,
+			patch: `[{"op":"test","path":"/n","value":1.0}]`,
+			want:  `{"n":1}`,
+		},
+		{
+			name:    "replacing a missing member",
+			doc:     `{"foo":"bar"}`,
+			patch:   `[{"op":"replace","path":"/baz","value":"qux"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "moving a value into its own child",
+			doc:     `{"foo":{"bar":1}}`,
+			patch:   `[{"op":"move","from":"/foo","path":"/foo/bar"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "array index with a leading zero",
+			doc:     `{"foo":["a","b"]}`,
+			patch:   `[{"op":"remove","path":"/foo/01"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "unknown operation",
+			doc:     `{}`,
+			patch:   `[{"op":"frobnicate","path":"/foo"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "missing value",
+			doc:     `{}`,
+			patch:   `[{"op":"add","path":"/foo"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "path without a leading slash",
+			doc:     `{}`,
+			patch:   `[{"op":"add","path":"foo","value":1}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "not an array",
+			doc:     `{}`,
+			patch:   `{"op":"add","path":"/foo","value":1}`,
+			wantErr: ErrInvalidPatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply([]byte(tt.doc), []byte(tt.patch))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSONEqual(t, got, tt.want)
+		})
+	}
+}
+
+// a failed operation mustn't leave the earlier ones applied to the result
+func TestApplyIsAtomic(t *testing.T) {
+	got, err := Apply([]byte(`{"a":1}`), []byte(`[{"op":"add","path":"/b","value":2},{"op":"remove","path":"/c"}]`))
+	if err == nil {
+		t.Fatalf("got %s, want an error", got)
+	}
+	if got != nil {
+		t.Errorf("got %s, want nil", got)
+	}
+}
@@ -0,0 +1,192 @@
+package jwt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	key1 = "k1:0123456789abcdef0123456789abcdef"
+	key2 = "k2:fedcba9876543210fedcba9876543210"
+)
+
+func newKeyset(t *testing.T, keys, active string) *Keyset {
+	t.Helper()
+
+	ks, err := NewKeyset(keys, active)
+	if err != nil {
+		t.Fatalf("NewKeyset(%q, %q): %v", keys, active, err)
+	}
+	return ks
+}
+
+func TestNewKeyset(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    string
+		active  string
+		wantErr bool
+	}{
+		{"single key", key1, "k1", false},
+		{"several keys", key1 + ", " + key2, "k2", false},
+		{"missing secret", "k1:", "k1", true},
+		{"missing kid", ":0123456789abcdef0123456789abcdef", "", true},
+		{"no separator", "k1", "k1", true},
+		{"short secret", "k1:tooshort", "k1", true},
+		{"unknown active key", key1, "k2", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeyset(tt.keys, tt.active)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	ks := newKeyset(t, key1, "k1")
+
+	claims := Claims{
+		Subject:     "42",
+		SessionID:   "family",
+		Activated:   true,
+		Permissions: []string{"movies:read"},
+		Scoped:      true,
+		IssuedAt:    time.Now().Unix(),
+		Expiry:      time.Now().Add(time.Minute).Unix(),
+	}
+
+	token, err := ks.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsJWT(token) {
+		t.Errorf("IsJWT(%q) = false", token)
+	}
+
+	got, err := ks.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Subject != claims.Subject || got.SessionID != claims.SessionID || !got.Activated || !got.Scoped ||
+		len(got.Permissions) != 1 || got.Permissions[0] != "movies:read" || got.Expiry != claims.Expiry {
+		t.Errorf("got claims %+v, want %+v", got, claims)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ks := newKeyset(t, key1, "k1")
+
+	valid, err := ks.Sign(Claims{Subject: "1", Expiry: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := ks.Sign(Claims{Subject: "1", Expiry: time.Now().Add(-time.Second).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(valid, ".")
+
+	// a token whose claims were changed after it was signed
+	tamperedClaims, err := ks.Sign(Claims{Subject: "2", Expiry: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := parts[0] + "." + strings.Split(tamperedClaims, ".")[1] + "." + parts[2]
+
+	other := newKeyset(t, "k1:ffffffffffffffffffffffffffffffff", "k1")
+	forged, err := other.Sign(Claims{Subject: "1", Expiry: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknownKey := newKeyset(t, key2, "k2")
+	signedWithUnknownKey, err := unknownKey.Sign(Claims{Subject: "1", Expiry: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", valid, nil},
+		{"expired", expired, ErrExpiredToken},
+		{"tampered claims", tampered, ErrInvalidToken},
+		{"signed with a different secret", forged, ErrInvalidToken},
+		{"unknown key", signedWithUnknownKey, ErrUnknownKey},
+		{"too few segments", parts[0] + "." + parts[1], ErrInvalidToken},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".!!!", ErrInvalidToken},
+		{"bad header", "e30." + parts[1] + "." + parts[2], ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old := newKeyset(t, key1, "k1")
+
+	token, err := old.Sign(Claims{Subject: "1", Expiry: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// after adding a new key and making it active, tokens signed with the old key
+	// still verify, and new ones are signed with the new key
+	rotated := newKeyset(t, key1+","+key2, "k2")
+
+	if _, err := rotated.Verify(token); err != nil {
+		t.Errorf("token signed with the old key: %v", err)
+	}
+
+	newToken, err := rotated.Sign(Claims{Subject: "1", Expiry: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := old.Verify(newToken); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("token signed with the new key verified by the old keyset: got error %v, want %v", err, ErrUnknownKey)
+	}
+
+	// once the old key is removed its tokens are no longer accepted
+	retired := newKeyset(t, key2, "k2")
+
+	if _, err := retired.Verify(token); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("token signed with a removed key: got error %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestIsJWT(t *testing.T) {
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{"aaa.bbb.ccc", true},
+		{"ABCDEFGHIJKLMNOPQRSTUVWXYZ", false},
+		{"aaa.bbb", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsJWT(tt.token); got != tt.want {
+			t.Errorf("IsJWT(%q) = %t, want %t", tt.token, got, tt.want)
+		}
+	}
+}
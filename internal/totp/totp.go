@@ -0,0 +1,84 @@
+// Package totp implements the time-based one-time passwords described in RFC 6238,
+// using the defaults understood by authenticator apps: HMAC-SHA1, 6 digits and a 30
+// second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	digits = 6
+	period = 30 * time.Second
+	// the number of periods either side of the current one that a code is still
+	// accepted for, to allow for clock drift on the user's device.
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random 160-bit secret, base32 encoded as authenticator
+// apps expect.
+func GenerateSecret() string {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return encoding.EncodeToString(secret)
+}
+
+// URI returns the otpauth:// URI that authenticator apps use to enroll a secret,
+// usually by scanning it as a QR code.
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(digits))
+	params.Set("period", fmt.Sprint(int(period.Seconds())))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Validate reports whether code is valid for the secret at time t, and if so the time
+// step it was generated for. Callers should reject codes for a step at or before the
+// last one they accepted, so that a code can't be replayed while it is still valid
+// (RFC 6238 section 5.2).
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != digits {
+		return 0, false
+	}
+
+	counter := t.Unix() / int64(period.Seconds())
+
+	for i := int64(-skew); i <= skew; i++ {
+		if hmac.Equal([]byte(generate(key, uint64(counter+i))), []byte(code)) {
+			return counter + i, true
+		}
+	}
+	return 0, false
+}
+
+// generate computes the HOTP value (RFC 4226) for a counter.
+func generate(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", digits, value%1_000_000)
+}
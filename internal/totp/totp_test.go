@@ -0,0 +1,98 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA-1 seed from RFC 6238 Appendix B, base32 encoded
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+// The test vectors from RFC 6238 Appendix B. The RFC gives 8 digit codes, and a 6
+// digit code is the last 6 of them.
+var rfcVectors = []struct {
+	time int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+func TestGenerate(t *testing.T) {
+	for _, tt := range rfcVectors {
+		t.Run(tt.code, func(t *testing.T) {
+			want := tt.code[len(tt.code)-digits:]
+
+			got := generate([]byte("12345678901234567890"), uint64(tt.time)/uint64(period.Seconds()))
+			if got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	step := at.Unix() / int64(period.Seconds())
+
+	key := []byte("12345678901234567890")
+	code := func(step int64) string {
+		return generate(key, uint64(step))
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", rfcSecret, code(step), step, true},
+		{"previous step", rfcSecret, code(step - 1), step - 1, true},
+		{"next step", rfcSecret, code(step + 1), step + 1, true},
+		{"two steps ago", rfcSecret, code(step - 2), 0, false},
+		{"two steps ahead", rfcSecret, code(step + 2), 0, false},
+		{"lowercase secret", strings.ToLower(rfcSecret), code(step), step, true},
+		{"wrong length", rfcSecret, code(step)[1:], 0, false},
+		{"invalid secret", "not base32!", code(step), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, gotOK := Validate(tt.secret, tt.code, at)
+			if gotOK != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("got (%d, %t), want (%d, %t)", gotStep, gotOK, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret := GenerateSecret()
+
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 20 {
+		t.Errorf("got a %d byte secret, want 20", len(key))
+	}
+
+	if GenerateSecret() == secret {
+		t.Error("got the same secret twice")
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := URI("Greenlight", "alice@example.com", "JBSWY3DPEHPK3PXP")
+	want := "otpauth://totp/Greenlight:alice@example.com?algorithm=SHA1&digits=6&issuer=Greenlight&period=30&secret=JBSWY3DPEHPK3PXP"
+
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,14 @@
+CREATE TABLE
+  IF NOT EXISTS totp_credentials (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    secret text NOT NULL,
+    confirmed bool NOT NULL DEFAULT false,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+  );
+
+CREATE TABLE
+  IF NOT EXISTS recovery_codes (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    hash bytea NOT NULL,
+    PRIMARY KEY (user_id, hash)
+  );
@@ -0,0 +1,17 @@
+CREATE TABLE
+  IF NOT EXISTS login_attempts (
+    id bigserial PRIMARY KEY,
+    email citext NOT NULL,
+    ip_address text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+  );
+
+CREATE INDEX IF NOT EXISTS login_attempts_email_idx ON login_attempts (email, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_address_idx ON login_attempts (ip_address, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_created_at_idx ON login_attempts (created_at);
+
+CREATE TABLE
+  IF NOT EXISTS login_lockouts (
+    email citext PRIMARY KEY,
+    locked_until timestamp(0) with time zone NOT NULL
+  );
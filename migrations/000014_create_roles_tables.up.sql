@@ -0,0 +1,41 @@
+CREATE TABLE
+  IF NOT EXISTS roles (id bigserial PRIMARY KEY, name text UNIQUE NOT NULL);
+
+CREATE TABLE
+  IF NOT EXISTS role_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+  );
+
+CREATE TABLE
+  IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+  );
+
+-- permission needed to manage roles.
+INSERT INTO
+  permissions (code)
+VALUES
+  ('roles:admin');
+
+-- the default role for new signups, and an admin role holding every permission.
+INSERT INTO
+  roles (name)
+VALUES
+  ('user'),
+  ('admin');
+
+INSERT INTO
+  role_permissions
+SELECT
+  roles.id,
+  permissions.id
+FROM
+  roles,
+  permissions
+WHERE
+  (roles.name = 'user' AND permissions.code = 'movies:read')
+  OR roles.name = 'admin';
@@ -0,0 +1,8 @@
+DELETE FROM permissions WHERE code = 'movies:admin';
+
+DROP TABLE IF EXISTS movie_collaborators;
+
+DROP INDEX IF EXISTS movies_created_by_idx;
+
+ALTER TABLE movies
+DROP COLUMN IF EXISTS created_by;
@@ -0,0 +1,30 @@
+-- movies created before this migration have no owner, so only movies:admin can edit them.
+ALTER TABLE movies
+ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
+
+CREATE TABLE
+  IF NOT EXISTS movie_collaborators (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (movie_id, user_id)
+  );
+
+INSERT INTO
+  permissions (code)
+VALUES
+  ('movies:admin');
+
+INSERT INTO
+  role_permissions
+SELECT
+  roles.id,
+  permissions.id
+FROM
+  roles,
+  permissions
+WHERE
+  roles.name = 'admin'
+  AND permissions.code = 'movies:admin';
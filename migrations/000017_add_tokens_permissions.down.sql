@@ -0,0 +1,2 @@
+ALTER TABLE tokens
+DROP COLUMN IF EXISTS permissions;
@@ -0,0 +1,3 @@
+-- NULL means the token may use every permission its user holds.
+ALTER TABLE tokens
+ADD COLUMN IF NOT EXISTS permissions text[];
@@ -0,0 +1,28 @@
+CREATE TABLE
+  IF NOT EXISTS movie_revisions (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    version integer NOT NULL,
+    title text NOT NULL,
+    year integer NOT NULL,
+    runtime integer NOT NULL,
+    genres text[] NOT NULL,
+    changed_by bigint REFERENCES users ON DELETE SET NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (movie_id, version)
+  );
+
+-- earlier versions of existing movies are lost, but their current state is the
+-- starting point for their history.
+INSERT INTO
+  movie_revisions (movie_id, version, title, year, runtime, genres, changed_by, created_at)
+SELECT
+  id,
+  version,
+  title,
+  year,
+  runtime,
+  genres,
+  created_by,
+  created_at
+FROM
+  movies;
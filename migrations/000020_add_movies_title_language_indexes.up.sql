@@ -0,0 +1,6 @@
+-- movies_title_idx covers searches with the simple configuration, and each of the
+-- other search languages needs an index of its own
+CREATE INDEX IF NOT EXISTS movies_title_english_idx ON movies USING GIN (to_tsvector('english', title));
+CREATE INDEX IF NOT EXISTS movies_title_french_idx ON movies USING GIN (to_tsvector('french', title));
+CREATE INDEX IF NOT EXISTS movies_title_german_idx ON movies USING GIN (to_tsvector('german', title));
+CREATE INDEX IF NOT EXISTS movies_title_spanish_idx ON movies USING GIN (to_tsvector('spanish', title));
@@ -0,0 +1,2 @@
+ALTER TABLE totp_credentials
+DROP COLUMN IF EXISTS last_used_step;
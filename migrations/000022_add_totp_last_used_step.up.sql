@@ -0,0 +1,2 @@
+ALTER TABLE totp_credentials
+ADD COLUMN IF NOT EXISTS last_used_step bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS suspended bool NOT NULL DEFAULT false;